@@ -0,0 +1,123 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// A long-running backend that handles the selectors under a prefix in
+// place of the files there, from a -fastcgi or -scgi option of the form
+// `/prefix=address`.
+type backendConfig struct {
+	protocol string // "fastcgi" or "scgi"
+	spec     string // the option as given
+
+	// the selector prefix, normalized and without a trailing slash (so
+	// it is empty for all selectors)
+	prefix string
+
+	// the backend's address: `host:port` (tcp) or a path (unix)
+	network, address string
+}
+
+// Parse a -fastcgi or -scgi option.
+func parseBackendSpec(protocol, spec string) (*backendConfig, error) {
+	prefix, addr, ok := strings.Cut(spec, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") || addr == "" {
+		return nil, fmt.Errorf("must be of the form /prefix=address")
+	}
+	prefix, ok = normalizePath(prefix)
+	if !ok {
+		return nil, fmt.Errorf("invalid prefix %q", prefix)
+	}
+	b := &backendConfig{protocol: protocol, spec: spec, prefix: strings.TrimSuffix(prefix, "/")}
+
+	if strings.HasPrefix(addr, "unix:") {
+		b.network, b.address = "unix", strings.TrimPrefix(addr, "unix:")
+		if b.address == "" {
+			return nil, fmt.Errorf("missing unix socket path")
+		}
+	} else {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, err
+		}
+		b.network, b.address = "tcp", addr
+	}
+	return b, nil
+}
+
+// Find the backend for a normalized path, if any, and split the path
+// into the script name (the backend's prefix) and path info. The backend
+// with the longest matching prefix is used.
+func (c *config) findBackend(path string) (b *backendConfig, scriptName, pathInfo string) {
+	for _, candidate := range c.backends {
+		if (b == nil || len(candidate.prefix) > len(b.prefix)) &&
+			strings.HasPrefix(path, candidate.prefix) &&
+			(len(path) == len(candidate.prefix) || path[len(candidate.prefix)] == '/') {
+			b = candidate
+		}
+	}
+	if b == nil {
+		return nil, "", ""
+	}
+	return b, b.prefix, path[len(b.prefix):]
+}
+
+// The name of a backend for the logs.
+func (b *backendConfig) String() string {
+	if b.protocol == "scgi" {
+		return "SCGI " + b.spec
+	}
+	return "FastCGI " + b.spec
+}
+
+// Run a request with a backend.
+func runBackend(client *client, b *backendConfig, selector, scriptName, pathInfo, query, search string) response {
+	if b.protocol == "scgi" {
+		return runSCGI(client, b, selector, scriptName, pathInfo, query, search)
+	}
+	return runFastCGI(client, b, selector, scriptName, pathInfo, query, search)
+}
+
+// Make the variables for a backend: the same environment a CGI would get.
+func backendEnv(client *client, selector, scriptName, pathInfo, query, search string) []string {
+	return cgiEnv(client, selector, docRoot+scriptName, scriptName, pathInfo, query, search)
+}
+
+// A connection to a backend. Each read must finish within -backendtmo,
+// and the whole request within -cgitmo (if set), as for a CGI.
+type backendConn struct {
+	net.Conn
+	timeout  time.Duration // for each read
+	deadline time.Time     // zero if none
+}
+
+// Connect to a backend, within -backendtmo.
+func dialBackend(b *backendConfig) (net.Conn, error) {
+	c := getConfig()
+	conn, err := net.DialTimeout(b.network, b.address, c.backendTimeout)
+	if err != nil {
+		return nil, err
+	}
+	bc := &backendConn{Conn: conn, timeout: c.backendTimeout}
+	if c.cgiTimeout != 0 {
+		bc.deadline = time.Now().Add(c.cgiTimeout)
+		conn.SetDeadline(bc.deadline)
+	}
+	return bc, nil
+}
+
+func (c *backendConn) Read(p []byte) (int, error) {
+	if c.timeout != 0 {
+		deadline := time.Now().Add(c.timeout)
+		if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+			deadline = c.deadline
+		}
+		c.SetReadDeadline(deadline)
+	}
+	return c.Conn.Read(p)
+}
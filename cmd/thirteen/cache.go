@@ -0,0 +1,168 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A CGI's output in the cache.
+type cacheEntry struct {
+	key     string
+	output  []byte
+	status  statusCode
+	expires time.Time
+}
+
+// The CGI output cache (-cgicache), with the least recently used entries
+// removed first when it is full.
+var cgiCache = struct {
+	sync.Mutex
+	entries map[string]*list.Element // of *cacheEntry
+	lru     list.List                // most recently used first
+	size    int                      // bytes of output
+}{entries: make(map[string]*list.Element)}
+
+// How a CGI request went with the cache: whether it was found there, or
+// else what is needed to store the CGI's output once it has been sent.
+type cacheResult struct {
+	hit    bool
+	key    string
+	ttl    time.Duration // 0 if the output can't be stored
+	status statusCode
+	output bytes.Buffer
+	tooBig bool // the output can't be stored, so isn't kept
+	done   bool // all of the output has been read
+}
+
+// The name of a cache result for the access log.
+func (r *cacheResult) String() string {
+	if r.hit {
+		return "hit"
+	}
+	return "miss"
+}
+
+// The cache key for a CGI request: the selector (as the client sent it,
+// which the CGI is given), query, and search, and the listener's host and
+// port (which the CGI is also given). Requests that differ only by client
+// share an entry. (CGIs whose output depends on the client should not be
+// cached.)
+func cgiCacheKey(client *client, selector, query, search string) string {
+	return strings.Join([]string{client.listener.getServerHost(), client.listener.getServerPort(), selector, query, search}, "\x00")
+}
+
+// The largest output that may be cached for one request: an eighth of the
+// cache, so that no one entry (or request being cached) takes it all.
+func maxCacheEntrySize() int {
+	return getConfig().cgiCacheSize / 8
+}
+
+// Look up a CGI request in the cache, unless the cache is disabled, and
+// note the result in the client. On a hit, the response is the cached
+// output. The cache is disabled if it has no room, or if nothing can be
+// cached: there is no -cgicache time, and CGIs can't give their own
+// without -cgiheaders.
+func lookupCGICache(client *client, key string) (response, bool) {
+	client.cache = nil
+	if c := getConfig(); c.cgiCacheSize == 0 || c.cgiCacheTTL == 0 && !c.Bool("cgiheaders") {
+		return response{}, false
+	}
+	cgiCache.Lock()
+	defer cgiCache.Unlock()
+	if e, ok := cgiCache.entries[key]; ok {
+		entry := e.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			cgiCache.lru.MoveToFront(e)
+			client.cache = &cacheResult{hit: true}
+			return response{bytes.NewReader(entry.output), entry.status, nil}, true
+		}
+		removeCacheEntry(e)
+	}
+	client.cache = &cacheResult{key: key, ttl: getConfig().cgiCacheTTL}
+	return response{}, false
+}
+
+// Store a CGI's output in the cache, removing the least recently used
+// entries to make room for it.
+func storeCGICache(r *cacheResult) {
+	maxSize := getConfig().cgiCacheSize
+	if r.ttl == 0 || r.tooBig || !r.done || r.output.Len() > maxCacheEntrySize() {
+		return
+	}
+	entry := &cacheEntry{r.key, r.output.Bytes(), r.status, time.Now().Add(r.ttl)}
+
+	cgiCache.Lock()
+	defer cgiCache.Unlock()
+	if e, ok := cgiCache.entries[entry.key]; ok {
+		removeCacheEntry(e)
+	}
+	for cgiCache.size+len(entry.output) > maxSize {
+		removeCacheEntry(cgiCache.lru.Back())
+	}
+	cgiCache.entries[entry.key] = cgiCache.lru.PushFront(entry)
+	cgiCache.size += len(entry.output)
+}
+
+// Remove an entry from the cache, which must be locked.
+func removeCacheEntry(e *list.Element) {
+	entry := cgiCache.lru.Remove(e).(*cacheEntry)
+	delete(cgiCache.entries, entry.key)
+	cgiCache.size -= len(entry.output)
+}
+
+// Empty the cache.
+func clearCGICache() {
+	cgiCache.Lock()
+	defer cgiCache.Unlock()
+	cgiCache.entries = make(map[string]*list.Element)
+	cgiCache.lru.Init()
+	cgiCache.size = 0
+}
+
+// Reads a CGI's output while keeping a copy of it for the cache.
+type cachingReader struct {
+	io.ReadCloser
+	result *cacheResult
+}
+
+func (c cachingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	r := c.result
+	if !r.tooBig {
+		if r.output.Len()+n > maxCacheEntrySize() {
+			r.tooBig = true
+			r.output = bytes.Buffer{}
+		} else {
+			r.output.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		r.done = true
+	}
+	return n, err
+}
+
+// Parse a CGI's Cache-Control header for how long its output may be
+// cached: its max-age, or 0 for no-store or no-cache. ok is false if the
+// header says neither.
+func parseCacheControl(s string) (ttl time.Duration, ok bool) {
+	for _, directive := range strings.Split(s, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache":
+			return 0, true
+		case "max-age":
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && seconds >= 0 {
+				ttl, ok = time.Duration(seconds)*time.Second, true
+			}
+		}
+	}
+	return ttl, ok
+}
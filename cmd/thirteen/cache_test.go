@@ -0,0 +1,184 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		ttl    time.Duration
+		ok     bool
+	}{
+		{"", 0, false},
+		{"max-age=60", time.Minute, true},
+		{"public, max-age=\"5\"", 5 * time.Second, true},
+		{"max-age=0", 0, true},
+		{"no-store", 0, true},
+		{"max-age=60, no-cache", 0, true},
+		{"max-age=-1", 0, false},
+		{"max-age=soon", 0, false},
+		{"private", 0, false},
+	} {
+		t.Run(tc.header, func(t *testing.T) {
+			at := assert.New(t)
+			ttl, ok := parseCacheControl(tc.header)
+			at.Equal(tc.ttl, ttl)
+			at.Equal(tc.ok, ok)
+		})
+	}
+}
+
+// Store output in the cache as if a CGI had sent it.
+func storeTestOutput(t *testing.T, key string, output []byte, ttl time.Duration) {
+	c := &client{}
+	lookupCGICache(c, key)
+	require.NotNil(t, c.cache)
+	c.cache.ttl, c.cache.status = ttl, okStatus
+	_, err := io.ReadAll(cachingReader{io.NopCloser(bytes.NewReader(output)), c.cache})
+	require.NoError(t, err)
+	storeCGICache(c.cache)
+}
+
+func TestCGICacheEntries(t *testing.T) {
+	at := assert.New(t)
+	useConfig(t, "-cgicache", "60", "-cgicachesize", "1")
+	t.Cleanup(clearCGICache)
+	entry := bytes.Repeat([]byte("x"), maxCacheEntrySize())
+
+	storeTestOutput(t, "a", []byte("hello"), time.Minute)
+	c := &client{}
+	response, ok := lookupCGICache(c, "a")
+	at.True(ok)
+	at.True(c.cache.hit)
+	output, _ := io.ReadAll(response)
+	at.Equal("hello", string(output))
+	at.Equal(okStatus, response.status)
+
+	// expired
+	storeTestOutput(t, "b", []byte("hello"), time.Nanosecond)
+	_, ok = lookupCGICache(c, "b")
+	at.False(ok)
+	at.False(c.cache.hit)
+
+	// too big for an entry
+	storeTestOutput(t, "c", append(entry, 'x'), time.Minute)
+	_, ok = lookupCGICache(c, "c")
+	at.False(ok)
+
+	// the least recently used entry is removed to make room
+	for i := 0; i < 7; i++ {
+		storeTestOutput(t, fmt.Sprint(i), entry, time.Minute)
+	}
+	_, ok = lookupCGICache(c, "a")
+	at.True(ok)
+	storeTestOutput(t, "7", entry, time.Minute)
+	_, ok = lookupCGICache(c, "0")
+	at.False(ok)
+	_, ok = lookupCGICache(c, "a")
+	at.True(ok)
+	_, ok = lookupCGICache(c, "7")
+	at.True(ok)
+}
+
+func TestCGICache(t *testing.T) {
+	root := useTestSite(t)
+	t.Cleanup(clearCGICache)
+	// a CGI that counts how many times it has run
+	count := "#!/bin/sh\nn=$(($(cat count 2>/dev/null || echo 0) + 1))\necho $n > count\n"
+	script := func(name, s string) {
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), []byte(count+s), 0755))
+	}
+	script("count.cgi", "echo \"$n $QUERY_STRING\"\n")
+	script("fail.cgi", "echo \"$n\"\nexit 1\n")
+	script("nostore.cgi", "printf 'Cache-Control: no-store\\n\\n'\necho \"$n\"\n")
+	script("maxage.cgi", "printf 'Cache-Control: max-age=60\\n\\n'\necho \"$n\"\n")
+	script("maxage0.cgi", "printf 'Cache-Control: max-age=0\\n\\n'\necho \"$n\"\n")
+	script("headers.cgi", "printf '\\n'\necho \"$n\"\n")
+
+	for _, tc := range []struct {
+		name      string
+		args      []string
+		selectors []string
+		responses []string
+		log       string // the cache field logged for the last request
+	}{
+		{"Disabled", nil, []string{"/count.cgi", "/count.cgi"}, []string{"1 \n", "2 \n"}, ""},
+		{"Same request", []string{"-cgicache", "60"}, []string{"/count.cgi?a", "/count.cgi?a"}, []string{"1 a\n", "1 a\n"}, "cache=hit"},
+		{"Different query", []string{"-cgicache", "60"}, []string{"/count.cgi?a", "/count.cgi?b", "/count.cgi?a"}, []string{"1 a\n", "2 b\n", "1 a\n"}, "cache=hit"},
+		{"Different selector for the same CGI", []string{"-cgicache", "60"}, []string{"/count.cgi?a", "/./count.cgi?a"}, []string{"1 a\n", "2 a\n"}, "cache=miss"},
+		{"Failure", []string{"-cgicache", "60"}, []string{"/fail.cgi", "/fail.cgi"}, []string{"1\n", "2\n"}, "cache=miss"},
+		{"No room", []string{"-cgicache", "60", "-cgicachesize", "0"}, []string{"/count.cgi", "/count.cgi"}, []string{"1 \n", "2 \n"}, ""},
+		{"No store", []string{"-cgicache", "60", "-cgiheaders"}, []string{"/nostore.cgi", "/nostore.cgi"}, []string{"1\n", "2\n"}, ""},
+		{"Max age of 0", []string{"-cgicache", "60", "-cgiheaders"}, []string{"/maxage0.cgi", "/maxage0.cgi"}, []string{"1\n", "2\n"}, ""},
+		{"Max age", []string{"-cgicache", "60", "-cgiheaders"}, []string{"/maxage.cgi", "/maxage.cgi"}, []string{"1\n", "1\n"}, "cache=hit"},
+		{"Max age without -cgicache", []string{"-cgiheaders"}, []string{"/maxage.cgi", "/maxage.cgi"}, []string{"1\n", "1\n"}, "cache=hit"},
+		{"No max age without -cgicache", []string{"-cgiheaders"}, []string{"/headers.cgi", "/headers.cgi"}, []string{"1\n", "2\n"}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			at := assert.New(t)
+			useConfig(t, tc.args...)
+			clearCGICache()
+			os.Remove(filepath.Join(root, "count"))
+			var log string
+			for i, selector := range tc.selectors {
+				log = captureLog(t, func() {
+					at.Equal(tc.responses[i], testRequest(t, selector), selector)
+				})
+			}
+			if tc.log != "" {
+				at.Contains(log, " "+tc.log)
+			} else {
+				at.NotContains(log, "cache=")
+			}
+		})
+	}
+}
+
+func TestCGIResponseCaching(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		output string
+		kept   string // the output kept for the cache
+	}{
+		{"No max age", "\nhello\n", ""},
+		{"Max age", "Cache-Control: max-age=60\n\nhello\n", "hello\n"},
+		{"No store", "Cache-Control: no-store\n\nhello\n", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			at := assert.New(t)
+			useConfig(t, "-cgiheaders")
+			c := &client{}
+			lookupCGICache(c, "key")
+			require.NotNil(t, c.cache)
+
+			response := cgiResponse(c, "/test.cgi", nil, io.NopCloser(strings.NewReader(tc.output)))
+			_, caching := response.Reader.(cachingReader)
+			at.Equal(tc.kept != "", caching)
+			output, err := io.ReadAll(response)
+			require.NoError(t, err)
+			at.Equal("hello\n", string(output))
+			at.Equal(tc.kept, c.cache.output.String())
+		})
+	}
+}
+
+func TestCacheLog(t *testing.T) {
+	at := assert.New(t)
+	r := requestInfo{host: "192.0.2.1", requestTime: time.Unix(0, 0).UTC(), request: []byte("/test.cgi"), status: okStatus, cache: &cacheResult{hit: true}}
+	at.Equal(`192.0.2.1 - - [1970-01-01T00:00:00Z] "/test.cgi" 200 - cache=hit`, r.String())
+	r.cache = &cacheResult{}
+	at.Equal(`192.0.2.1 - - [1970-01-01T00:00:00Z] "/test.cgi" 200 - cache=miss`, r.String())
+}
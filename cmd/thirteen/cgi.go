@@ -0,0 +1,370 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// A resource limit (as for setrlimit) to set for a process.
+type processLimit struct {
+	resource int
+	value    uint64
+}
+
+// The options for CGI resource limits, and the unit of each in bytes or
+// whatever the limit counts. processLimitResources gives the resource
+// for each one that the system supports.
+var cgiLimitOptions = []struct {
+	name string
+	unit uint64
+}{
+	{"cgicpu", 1},
+	{"cgifiles", 1},
+	{"cgifsize", 1 << 20},
+	{"cgimem", 1 << 20},
+	{"cgiprocs", 1},
+}
+
+// The name (argv[0]) this program is run with to set resource limits and
+// then run a CGI (see runLimitHelper).
+const limitHelperName = "thirteen-cgi-limits"
+
+// This program's executable, to run as the limit helper; empty if it
+// can't be run (as within a -chroot root).
+var limitHelperPath string
+
+// Change cmd to run through the limit helper, so the limits are set
+// before the command starts.
+func useLimitHelper(cmd *exec.Cmd, limits []processLimit) {
+	specs := make([]string, len(limits))
+	for i, l := range limits {
+		specs[i] = fmt.Sprintf("%d=%d", l.resource, l.value)
+	}
+	cmd.Args = append([]string{limitHelperName, strings.Join(specs, ","), cmd.Path}, cmd.Args...)
+	cmd.Path = limitHelperPath
+}
+
+// Whether a file is run as a CGI: it has the .cgi extension, the
+// extension for dynamic CGIs (-dcgi), or an extension with an interpreter
+// (-interpreter).
+func isCGIPath(path string) bool {
+	return strings.HasSuffix(path, cgiExt) || isDynamicCGIPath(path) || cgiInterpreter(path) != nil
+}
+
+// Whether a file is run as a dynamic CGI, whose output is made into a
+// menu.
+func isDynamicCGIPath(path string) bool {
+	ext := getConfig().dcgiExt
+	return ext != "" && strings.HasSuffix(path, ext)
+}
+
+// The interpreter and its arguments for a CGI, or nil if the CGI is run
+// directly.
+func cgiInterpreter(path string) []string {
+	return getConfig().interpreters[filepath.Ext(path)]
+}
+
+// Find an interpreter in -cgipath (the PATH that CGIs are given), unless
+// its path is given.
+func findInterpreter(name string) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, nil
+	}
+	for _, dir := range filepath.SplitList(configString("cgipath")) {
+		path := filepath.Join(dir, name)
+		if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("interpreter %s not found in -cgipath", name)
+}
+
+// How long a CGI has to exit after SIGTERM before it is sent SIGKILL.
+var cgiKillDelay = 5 * time.Second
+
+// Limits the number of CGIs running at once (-cgimax).
+var cgiLimit = newLimiter(math.MaxInt32)
+
+// Limits the number of copies of each CGI running at once (-cgiscriptmax),
+// by file system path. A script's limiter is kept only while it is in use
+// (held or waited for).
+var cgiScriptLimits = struct {
+	sync.Mutex
+	m map[string]*scriptLimit
+}{m: make(map[string]*scriptLimit)}
+
+type scriptLimit struct {
+	*limiter
+	limit int
+	users int
+}
+
+// Requests that had to wait for a CGI to be allowed to run, and those that
+// were turned away because the server was busy.
+var (
+	cgiQueued   atomic.Uint64
+	cgiRejected atomic.Uint64
+)
+
+// Wait (up to -cgiwait) for a CGI to be allowed to run under -cgimax and
+// -cgiscriptmax. The returned function must be called once the CGI has
+// exited (or if it isn't started). The error is for a busy server.
+func acquireCGI(fsPath string) (release func(), err *responseError) {
+	c := getConfig()
+
+	cgiScriptLimits.Lock()
+	script := cgiScriptLimits.m[fsPath]
+	if script == nil {
+		script = &scriptLimit{limiter: newLimiter(c.cgiScriptMax), limit: c.cgiScriptMax}
+		cgiScriptLimits.m[fsPath] = script
+	} else if script.limit != c.cgiScriptMax {
+		script.limit = c.cgiScriptMax
+		script.setLimit(c.cgiScriptMax)
+	}
+	script.users++
+	cgiScriptLimits.Unlock()
+
+	done := func() {
+		cgiScriptLimits.Lock()
+		if script.users--; script.users == 0 {
+			delete(cgiScriptLimits.m, fsPath)
+		}
+		cgiScriptLimits.Unlock()
+	}
+
+	// take a slot for the script, then one among all CGIs
+	take := func(cancel <-chan struct{}) bool {
+		if script.acquire(cancel) {
+			if cgiLimit.acquire(cancel) {
+				return true
+			}
+			script.release()
+		}
+		return false
+	}
+	release = func() {
+		cgiLimit.release()
+		script.release()
+		done()
+	}
+
+	// try without waiting first, so only requests that wait are counted
+	now := make(chan struct{})
+	close(now)
+	if take(now) {
+		return release, nil
+	}
+	if c.cgiWait != 0 {
+		cgiQueued.Add(1)
+		wait := make(chan struct{})
+		timer := time.AfterFunc(c.cgiWait, func() { close(wait) })
+		defer timer.Stop()
+		if take(wait) {
+			return release, nil
+		}
+	}
+	done()
+	cgiRejected.Add(1)
+	return nil, serviceUnavailableError
+}
+
+// A CGI that has been started and not yet waited for. Each CGI runs in its
+// own process group, so it and any processes it started are signaled
+// together.
+type runningCGI struct {
+	cmd      *exec.Cmd
+	path     string // the CGI's file system path, for logging
+	started  time.Time
+	done     chan struct{} // closed when the CGI has been waited for
+	timer    *time.Timer   // for -cgitmo; nil if there is no timeout
+	stopping bool          // SIGTERM has been sent
+	killOnce sync.Once
+	release  func() // from acquireCGI; may be nil
+}
+
+// CGIs that have been started and not yet waited for.
+var runningCGIs = struct {
+	sync.Mutex
+	m map[*exec.Cmd]*runningCGI
+}{m: make(map[*exec.Cmd]*runningCGI)}
+
+// Keep track of a CGI started by runCGI from the file at fsPath, and stop
+// it if it runs for longer than -cgitmo. release is called once the CGI
+// has been waited for.
+func startedCGI(cmd *exec.Cmd, fsPath string, release func()) {
+	cgi := &runningCGI{cmd: cmd, path: fsPath, started: time.Now(), done: make(chan struct{}), release: release}
+	if timeout := getConfig().cgiTimeout; timeout != 0 {
+		cgi.timer = time.AfterFunc(timeout, func() {
+			stopCGI(cmd, fmt.Sprintf("timed out after %v", timeout))
+		})
+	}
+	runningCGIs.Lock()
+	runningCGIs.m[cmd] = cgi
+	runningCGIs.Unlock()
+}
+
+// How a CGI exited, for the access log.
+type cgiExit struct {
+	state   *os.ProcessState // nil if the CGI couldn't be waited for
+	runtime time.Duration
+}
+
+// Wait for a CGI started by runCGI to exit.
+func waitCGI(cmd *exec.Cmd) *cgiExit {
+	cmd.Wait()
+	runningCGIs.Lock()
+	cgi := runningCGIs.m[cmd]
+	delete(runningCGIs.m, cmd)
+	runningCGIs.Unlock()
+	exit := &cgiExit{state: cmd.ProcessState}
+	if cgi != nil {
+		exit.runtime = time.Since(cgi.started)
+		if cgi.timer != nil {
+			cgi.timer.Stop()
+		}
+		close(cgi.done)
+		if cgi.release != nil {
+			cgi.release()
+		}
+	}
+	return exit
+}
+
+// Whether the CGI exited with status 0.
+func (e *cgiExit) success() bool {
+	return e.state != nil && e.state.Success()
+}
+
+// The exit status (or signal) and the running time in seconds, as in
+// "exit=0 cgitime=0.012" or "signal=9 cgitime=5.003".
+func (e *cgiExit) String() string {
+	status := "exit=-"
+	if e.state != nil {
+		if ws, ok := e.state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			status = fmt.Sprintf("signal=%d", ws.Signal())
+		} else {
+			status = fmt.Sprintf("exit=%d", e.state.ExitCode())
+		}
+	}
+	return fmt.Sprintf("%s cgitime=%.3f", status, e.runtime.Seconds())
+}
+
+// Stop a running CGI for the given reason (which is logged): send SIGTERM
+// to its process group, then SIGKILL if it hasn't exited within
+// cgiKillDelay. Return the CGI, or nil if it isn't running or is already
+// being stopped.
+func stopCGI(cmd *exec.Cmd, reason string) *runningCGI {
+	runningCGIs.Lock()
+	cgi := runningCGIs.m[cmd]
+	if cgi == nil || cgi.stopping {
+		runningCGIs.Unlock()
+		return nil
+	}
+	cgi.stopping = true
+	delay := cgiKillDelay
+	runningCGIs.Unlock()
+
+	logf("CGI %s (pid %d) %s; stopping it", cgi.path, cmd.Process.Pid, reason)
+	signalProcessGroup(cmd, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-cgi.done:
+		case <-time.After(delay):
+			cgi.kill()
+		}
+	}()
+	return cgi
+}
+
+// Stop a CGI if its client goes away while it runs, even if it isn't
+// sending anything (so no write fails). A client sends nothing after its
+// request, so it has gone away once a read from it fails; a client that
+// only shuts down its side of the connection is taken to have gone away
+// too. The returned function stops watching.
+func watchClient(client *client, cmd *exec.Cmd) (stop func()) {
+	stopped := make(chan struct{})
+	client.SetReadDeadline(time.Time{})
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			_, err := client.Read(buf)
+			if err == nil {
+				continue
+			}
+			select {
+			case <-stopped:
+			default:
+				reason := "client closed the connection"
+				if err != io.EOF {
+					reason = fmt.Sprintf("could not read from client (%v)", err)
+				}
+				stopCGI(cmd, reason)
+			}
+			return
+		}
+	}()
+	return func() {
+		close(stopped)
+		// end the read (unless the connection can't have a deadline,
+		// in which case the read ends when the connection is closed)
+		client.SetReadDeadline(time.Now())
+	}
+}
+
+// Send SIGKILL to a CGI's process group (once).
+func (cgi *runningCGI) kill() {
+	cgi.killOnce.Do(func() {
+		logf("CGI %s (pid %d) did not exit after SIGTERM; killing it", cgi.path, cgi.cmd.Process.Pid)
+		signalProcessGroup(cgi.cmd, syscall.SIGKILL)
+	})
+}
+
+// Stop all running CGIs, as at shutdown, and wait up to cgiKillDelay for
+// them to exit before killing any that are left. Return how many were
+// stopped.
+func killCGIs() (stopped int) {
+	runningCGIs.Lock()
+	cmds := make([]*exec.Cmd, 0, len(runningCGIs.m))
+	for cmd := range runningCGIs.m {
+		cmds = append(cmds, cmd)
+	}
+	runningCGIs.Unlock()
+
+	var cgis []*runningCGI
+	for _, cmd := range cmds {
+		if cgi := stopCGI(cmd, "is still running at shutdown"); cgi != nil {
+			cgis = append(cgis, cgi)
+		}
+	}
+
+	timeout := time.NewTimer(cgiKillDelay)
+	defer timeout.Stop()
+	timedOut := false
+	for _, cgi := range cgis {
+		if !timedOut {
+			select {
+			case <-cgi.done:
+				continue
+			case <-timeout.C:
+				timedOut = true
+			}
+		}
+		select {
+		case <-cgi.done:
+		default:
+			cgi.kill()
+		}
+	}
+	return len(cgis)
+}
@@ -0,0 +1,323 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Start a shell command the way runCGI starts a CGI.
+func startTestCGI(t *testing.T, script string) *exec.Cmd {
+	cmd := exec.Command("/bin/sh", "-c", script)
+	setProcessGroup(cmd)
+	require.NoError(t, cmd.Start())
+	startedCGI(cmd, "/test.cgi", nil)
+	return cmd
+}
+
+// Whether any process in a CGI's process group is still running (not a
+// zombie, since orphans might not be reaped promptly). Waits a little for
+// processes to die.
+func processGroupExists(cmd *exec.Cmd) bool {
+	for i := 0; i < 20; i++ {
+		if !processGroupRunning(cmd.Process.Pid) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+func processGroupRunning(pgid int) bool {
+	if syscall.Kill(-pgid, 0) != nil {
+		return false
+	}
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil || len(stats) == 0 {
+		// no /proc; assume the processes are zombies
+		return false
+	}
+	for _, path := range stats {
+		stat, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		// pid (comm) state ppid pgrp ...
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if len(fields) >= 3 && fields[0] != "Z" && fields[2] == strconv.Itoa(pgid) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCGITimeout(t *testing.T) {
+	at := assert.New(t)
+	useConfig(t, "-cgitmo", "1")
+
+	start := time.Now()
+	cmd := startTestCGI(t, "sleep 30 & wait")
+	exit := waitCGI(cmd)
+	at.False(exit.success())
+	at.Less(time.Since(start), 10*time.Second)
+	at.GreaterOrEqual(exit.runtime, time.Second)
+	at.False(processGroupExists(cmd))
+
+	// the script is logged, not its interpreter
+	root := useTestSite(t)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "sleep.sh"), []byte("sleep 30\n"), 0644))
+	useConfig(t, "-cgitmo", "1", "-interpreter", ".sh=sh")
+	log := captureLog(t, func() { testRequest(t, "/sleep.sh") })
+	at.Regexp(`CGI `+regexp.QuoteMeta(filepath.Join(root, "sleep.sh"))+` \(pid \d+\) timed out after 1s; stopping it`, log)
+}
+
+func TestCGIClientGone(t *testing.T) {
+	at := assert.New(t)
+	root := useTestSite(t)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "sleep.cgi"), []byte("#!/bin/sh\nsleep 30\n"), 0755))
+	useConfig(t)
+
+	start := time.Now()
+	log := captureLog(t, func() {
+		client, done := testConn()
+		_, err := client.Write([]byte("/sleep.cgi\r\n"))
+		require.NoError(t, err)
+		// the CGI sends nothing, so only a read notices the client is gone
+		time.Sleep(100 * time.Millisecond)
+		client.Close()
+		<-done
+	})
+	at.Less(time.Since(start), 5*time.Second)
+	at.Contains(log, "sleep.cgi (pid ")
+	at.Contains(log, ") client closed the connection; stopping it")
+	at.Contains(log, `"/sleep.cgi" 500 - `)
+	at.Contains(log, " signal=15 ")
+}
+
+func TestStopCGIKillsAfterDelay(t *testing.T) {
+	at := assert.New(t)
+	oldDelay := cgiKillDelay
+	cgiKillDelay = 100 * time.Millisecond
+	t.Cleanup(func() { cgiKillDelay = oldDelay })
+
+	// the shell and its child both ignore SIGTERM
+	cmd := startTestCGI(t, `trap "" TERM; sleep 30 & wait`)
+	time.Sleep(100 * time.Millisecond)
+	var exit *cgiExit
+	log := captureLog(t, func() {
+		at.NotNil(stopCGI(cmd, "test"))
+		at.Nil(stopCGI(cmd, "test again"))
+		exit = waitCGI(cmd)
+	})
+	pid := cmd.Process.Pid
+	at.Contains(log, fmt.Sprintf("CGI /test.cgi (pid %d) test; stopping it", pid))
+	at.Contains(log, fmt.Sprintf("CGI /test.cgi (pid %d) did not exit after SIGTERM; killing it", pid))
+	at.Equal(syscall.SIGKILL, exit.state.Sys().(syscall.WaitStatus).Signal())
+	at.Regexp(`^signal=9 cgitime=0\.\d{3}$`, exit.String())
+	at.False(processGroupExists(cmd))
+	at.Nil(stopCGI(cmd, "after exit"))
+}
+
+func TestKillCGIs(t *testing.T) {
+	at := assert.New(t)
+
+	// the second CGI's child is in its process group, so is stopped too
+	cmds := []*exec.Cmd{startTestCGI(t, "sleep 30"), startTestCGI(t, "sleep 30 & wait")}
+	for _, cmd := range cmds {
+		go waitCGI(cmd)
+	}
+	at.Equal(2, killCGIs())
+	for _, cmd := range cmds {
+		at.False(processGroupExists(cmd))
+	}
+	at.Equal(0, killCGIs())
+}
+
+func TestCGILimits(t *testing.T) {
+	if len(processLimitResources) == 0 {
+		t.Skip("resource limits are not supported")
+	}
+	at := assert.New(t)
+	exe, err := os.Executable()
+	require.NoError(t, err)
+
+	root := useTestSite(t)
+	oldHelper := limitHelperPath
+	limitHelperPath = exe
+	t.Cleanup(func() { limitHelperPath = oldHelper })
+	require.NoError(t, os.WriteFile(filepath.Join(root, "limits.cgi"), []byte("#!/bin/sh\necho \"$0 $2\"\nwhile read -r line; do echo \"$line\"; done < /proc/$$/limits\n"), 0755))
+	// (the CGI starts no process, which -cgiprocs might not allow)
+	useConfig(t, "-cgicpu", "10", "-cgifiles", "20", "-cgimem", "300", "-cgifsize", "2", "-cgiprocs", "400")
+
+	response := testRequest(t, "/limits.cgi?q")
+	at.True(strings.HasPrefix(response, filepath.Join(root, "limits.cgi")+" q\n"), response)
+	for _, re := range []string{
+		`Max cpu time +10 +10 `,
+		`Max open files +20 +20 `,
+		`Max address space +314572800 +314572800 `,
+		`Max file size +2097152 +2097152 `,
+		`Max processes +400 +400 `,
+	} {
+		at.Regexp(re, response)
+	}
+
+	// the CGI is run through the limit helper
+	require.NoError(t, os.WriteFile(filepath.Join(root, "hello.cgi"), []byte("#!/bin/sh\necho hello\n"), 0755))
+	limitHelperPath = filepath.Join(root, "nonexistent")
+	useConfig(t, "-cgifiles", "20")
+	at.Equal("3Internal server error.\t\tlocalhost\t70\r\n.\r\n", testRequest(t, "/hello.cgi"))
+
+	// or isn't run if the helper is unknown
+	limitHelperPath = ""
+	at.Equal("3Internal server error.\t\tlocalhost\t70\r\n.\r\n", testRequest(t, "/hello.cgi"))
+
+	for _, specs := range []string{"", "x=1", "7=lots"} {
+		at.Error(setLimits(specs), specs)
+	}
+
+	// the helper can't be run within a -chroot root
+	c, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-chroot", "-cgifiles", "20"})
+	require.NoError(t, err)
+	at.EqualError(c.check(), "CGI resource limits cannot be used with -chroot")
+}
+
+func TestCGIOutputLimit(t *testing.T) {
+	at := assert.New(t)
+
+	root := useTestSite(t)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "big.cgi"), []byte("#!/bin/sh\nwhile :; do echo 0123456789; done\n"), 0755))
+	useConfig(t, "-cgioutput", "1")
+
+	at.Len(testRequest(t, "/big.cgi"), 1<<20)
+}
+
+func TestCGIFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		script   string
+		response string
+	}{
+		{"Success", "echo hello", "hello\n"},
+		{"Success without output", "exit 0", ""},
+		{"Failure without output", "echo oops >&2; exit 1", "3Internal server error.\t\tlocalhost\t70\r\n.\r\n"},
+		{"Failure after output", "echo hello; exit 1", "hello\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			at := assert.New(t)
+
+			root := useTestSite(t)
+			require.NoError(t, os.WriteFile(filepath.Join(root, "test.cgi"), []byte("#!/bin/sh\n"+tc.script+"\n"), 0755))
+			useConfig(t, "-errorlog", os.DevNull)
+			require.NoError(t, openErrorLog())
+			t.Cleanup(func() { openErrorLog() })
+
+			at.Equal(tc.response, testRequest(t, "/test.cgi"))
+		})
+	}
+}
+
+func TestCGIExitString(t *testing.T) {
+	at := assert.New(t)
+
+	cmd := exec.Command("/bin/sh", "-c", "exit 3")
+	setProcessGroup(cmd)
+	require.NoError(t, cmd.Start())
+	startedCGI(cmd, "/test.cgi", nil)
+	exit := waitCGI(cmd)
+	at.False(exit.success())
+	at.Regexp(`^exit=3 cgitime=\d+\.\d{3}$`, exit.String())
+
+	r := requestInfo{host: "192.0.2.1", requestTime: time.Unix(0, 0).UTC(), request: []byte("/test.cgi"), status: internalServerErrorStatus, cgi: exit}
+	at.Contains(r.String(), `"/test.cgi" 500 - exit=3 cgitime=`)
+}
+
+func TestCGIInterpreter(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		file     string
+		mode     os.FileMode
+		args     []string
+		response string
+	}{
+		{"Executable CGI", "test.cgi", 0755, nil, "hello\n"},
+		{"CGI that is not executable", "test.cgi", 0644, nil, "3Forbidden.\t\tlocalhost\t70\r\n.\r\n"},
+		{"Script with an interpreter", "test.sh", 0644, []string{"-interpreter", ".sh=sh"}, "hello\n"},
+		{"Interpreter with arguments", "test.sh", 0644, []string{"-interpreter", "sh=sh -e"}, "hello\n"},
+		{"Script without an interpreter", "test.sh", 0644, nil, "#!/bin/sh\necho hello\n"},
+		{"Interpreter not found", "test.sh", 0644, []string{"-interpreter", ".sh=no-such-shell"}, "3Internal server error.\t\tlocalhost\t70\r\n.\r\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := useTestSite(t)
+			require.NoError(t, os.WriteFile(filepath.Join(root, tc.file), []byte("#!/bin/sh\necho hello\n"), tc.mode))
+			useConfig(t, tc.args...)
+
+			assert.Equal(t, tc.response, testRequest(t, "/"+tc.file))
+		})
+	}
+}
+
+func TestAcquireCGI(t *testing.T) {
+	at := assert.New(t)
+	useConfig(t, "-cgiscriptmax", "1", "-cgiwait", "0")
+	rejected, queued := cgiRejected.Load(), cgiQueued.Load()
+
+	// one copy of each script
+	releaseA, err := acquireCGI("/a.cgi")
+	require.Nil(t, err)
+	_, err = acquireCGI("/a.cgi")
+	at.Equal(serviceUnavailableError, err)
+	at.Equal(rejected+1, cgiRejected.Load())
+	releaseB, err := acquireCGI("/b.cgi")
+	require.Nil(t, err)
+	releaseB()
+
+	// wait for a copy to exit
+	useConfig(t, "-cgiscriptmax", "1", "-cgiwait", "5")
+	time.AfterFunc(50*time.Millisecond, releaseA)
+	releaseA, err = acquireCGI("/a.cgi")
+	require.Nil(t, err)
+	at.Equal(queued+1, cgiQueued.Load())
+
+	// the limit among all CGIs
+	useConfig(t, "-cgimax", "1", "-cgiwait", "0")
+	cgiLimit.setLimit(getConfig().cgiMax)
+	t.Cleanup(func() { cgiLimit.setLimit(math.MaxInt32) })
+	_, err = acquireCGI("/b.cgi")
+	at.Equal(serviceUnavailableError, err)
+	releaseA()
+	releaseB, err = acquireCGI("/b.cgi")
+	require.Nil(t, err)
+	releaseB()
+
+	cgiScriptLimits.Lock()
+	at.Empty(cgiScriptLimits.m)
+	cgiScriptLimits.Unlock()
+}
+
+func TestCGIBusy(t *testing.T) {
+	root := useTestSite(t)
+	fsPath := filepath.Join(root, "test.cgi")
+	require.NoError(t, os.WriteFile(fsPath, []byte("#!/bin/sh\necho hello\n"), 0755))
+	useConfig(t, "-cgiscriptmax", "1", "-cgiwait", "0")
+
+	release, err := acquireCGI(fsPath)
+	require.Nil(t, err)
+	assert.Equal(t, "3Server busy. Please try again later.\t\tlocalhost\t70\r\n.\r\n", testRequest(t, "/test.cgi"))
+	release()
+	assert.Equal(t, "hello\n", testRequest(t, "/test.cgi"))
+}
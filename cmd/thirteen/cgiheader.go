@@ -0,0 +1,207 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The most a CGI may send as headers (with -cgiheaders).
+const maxCGIHeaderBytes = 8 << 10
+
+// The most internal redirects (by a CGI's Location header) for a request.
+const maxCGIRedirects = 10
+
+// Whether a CGI is NPH (Non-Parsed Header): its output is sent unmodified
+// even with -cgiheaders. As in RFC 3875, a CGI is NPH if its name starts
+// with "nph-".
+func isNPHCGIPath(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), "nph-")
+}
+
+// Read the headers a CGI sent before its body, up to the blank line that
+// ends them. No headers are returned if the CGI sent nothing at all.
+func readCGIHeaders(r *bufio.Reader) (textproto.MIMEHeader, error) {
+	header := make(textproto.MIMEHeader)
+	read := 0
+	for {
+		line, err := r.ReadSlice('\n')
+		read += len(line)
+		if read > maxCGIHeaderBytes || err == bufio.ErrBufferFull {
+			return nil, fmt.Errorf("headers are longer than %d bytes", maxCGIHeaderBytes)
+		}
+		if err == io.EOF && read == 0 {
+			return header, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("headers not ended with a blank line")
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			return header, nil
+		}
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok || len(bytes.TrimSpace(name)) == 0 {
+			return nil, fmt.Errorf("invalid header line %q", line)
+		}
+		header.Add(textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(name))), string(bytes.TrimSpace(value)))
+	}
+}
+
+// Parse a Status header of the form `code [reason]`.
+func parseCGIStatus(s string) (status statusCode, reason string, err error) {
+	codeString, reason, _ := strings.Cut(s, " ")
+	code, err := strconv.Atoi(codeString)
+	if err != nil || len(codeString) != 3 || code < 100 || 599 < code {
+		return 0, "", fmt.Errorf("invalid status %q", s)
+	}
+	return statusCode(code), strings.TrimSpace(reason), nil
+}
+
+// A reader that closes something else, such as a CGI's standard output
+// when the client gets something other than what the CGI sent.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Make the response for a CGI that has been started, with stdout being
+// its standard output. With -cgiheaders, the CGI's headers are handled
+// first: the status is taken from Status, an error (with no body) is
+// sent in the format for X-Gopher-Type, Location makes an internal
+// redirect, X-Sendfile sends a file in place of the rest of the output,
+// and Cache-Control sets how long the output may be cached. The output of
+// a dynamic CGI is made into a menu.
+func cgiResponse(client *client, fsPath string, cmd *exec.Cmd, stdout io.ReadCloser) response {
+	var body io.ReadCloser = stdout
+	status := okStatus
+
+	if configBool("cgiheaders") && !isNPHCGIPath(fsPath) {
+		r := bufio.NewReader(stdout)
+		header, err := readCGIHeaders(r)
+		if err == nil && header.Get("Status") != "" {
+			var reason string
+			status, reason, err = parseCGIStatus(header.Get("Status"))
+			if err == nil && status >= 400 && isEmpty(r) {
+				// let the server send the error, in the right format
+				e := &responseError{status, reason}
+				if e.message == "" {
+					e.message = "Error."
+				}
+				return response{readCloser{strings.NewReader(makeCGIError(client, e, header.Get("X-Gopher-Type"))), stdout}, status, cmd}
+			}
+		}
+		if err != nil {
+			logf("CGI %s: %v", fsPath, err)
+			return response{readCloser{strings.NewReader(makeCGIError(client, internalServerErrorError, "")), stdout}, internalServerErrorStatus, cmd}
+		}
+		if location := header.Get("Location"); location != "" {
+			discardCGI(cmd, stdout)
+			return redirectCGI(client, fsPath, location)
+		}
+		if file := header.Get("X-Sendfile"); file != "" {
+			discardCGI(cmd, stdout)
+			return sendCGIFile(client, fsPath, file, status)
+		}
+		if ttl, ok := parseCacheControl(header.Get("Cache-Control")); ok && client.cache != nil {
+			client.cache.ttl = ttl
+		}
+		body = readCloser{r, stdout}
+	}
+
+	if isDynamicCGIPath(fsPath) {
+		host, port := client.listener.getServerHost(), client.listener.getServerPort()
+		body = newGPHReader(body, host, port)
+	}
+	if c := client.cache; c != nil && c.ttl != 0 && status < 400 {
+		// keep what is sent, to be cached if the CGI succeeds (there
+		// is nothing to keep if it can't be cached)
+		c.status = status
+		body = cachingReader{body, c}
+	}
+	return response{body, status, cmd}
+}
+
+// Stop reading a CGI's output, which isn't needed, and let it exit in the
+// background. How it exits isn't logged.
+func discardCGI(cmd *exec.Cmd, stdout io.Closer) {
+	go func() {
+		stdout.Close()
+		waitCGI(cmd)
+	}()
+}
+
+// Whether a reader has nothing more to read.
+func isEmpty(r *bufio.Reader) bool {
+	_, err := r.Peek(1)
+	return err != nil
+}
+
+// Make an error for a CGI's request: a menu for a menu (or a search, or
+// an unknown type), or a line of text for anything else.
+func makeCGIError(client *client, e *responseError, gopherType string) string {
+	if gopherType == "" || gopherType == "1" || gopherType == "7" {
+		return makeDirEntry('3', e.message, client.listener.getServerHost(), client.listener.getServerPort())
+	}
+	return e.message + "\r\n"
+}
+
+// Handle the selector a CGI gave in a Location header as if the client
+// had requested it. Only selectors on this server (starting with "/") can
+// be redirected to.
+func redirectCGI(client *client, fsPath, location string) response {
+	if !strings.HasPrefix(location, "/") {
+		logf("CGI %s: Location %q is not a selector on this server", fsPath, location)
+		return makeErrorResponse(client, internalServerErrorError)
+	}
+	if client.redirects++; client.redirects > maxCGIRedirects {
+		logf("CGI %s: too many redirects", fsPath)
+		return makeErrorResponse(client, internalServerErrorError)
+	}
+	path, query, _ := strings.Cut(location, "?")
+	return getResponseForRequest(client, location, path, query, "")
+}
+
+// Send the file a CGI gave in an X-Sendfile header, with the status it
+// gave. A relative path is relative to the CGI's directory. The file must
+// be under the site root and servable as if it had been requested, and
+// must not be a CGI (whose source would be sent).
+func sendCGIFile(client *client, fsPath, file string, status statusCode) response {
+	path := file
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(fsPath), path)
+	}
+	path = filepath.Clean(path)
+	root := docRoot
+	if !strings.HasSuffix(root, "/") {
+		root += "/"
+	}
+	if !strings.HasPrefix(path, root) {
+		logf("CGI %s: X-Sendfile %s is not under the site root", fsPath, file)
+		return makeErrorResponse(client, forbiddenError)
+	}
+
+	isFile, _, isCGI, err := getStats(path)
+	if err == nil && (!isFile || isCGI) {
+		err = forbiddenError
+	}
+	if err != nil {
+		logf("CGI %s: X-Sendfile %s: %s", fsPath, file, strings.ToLower(strings.TrimSuffix(err.message, ".")))
+		return makeErrorResponse(client, err)
+	}
+	f, e := os.Open(path)
+	if e != nil {
+		logf("CGI %s: X-Sendfile %s: %v", fsPath, file, e)
+		return makeErrorResponse(client, forbiddenError)
+	}
+	return response{f, status, nil}
+}
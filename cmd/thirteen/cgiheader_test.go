@@ -0,0 +1,89 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCGIStatus(t *testing.T) {
+	for _, tc := range []struct {
+		status  string
+		code    statusCode
+		reason  string
+		isError bool
+	}{
+		{"200", 200, "", false},
+		{"404 Not Found", 404, "Not Found", false},
+		{"503  Busy ", 503, "Busy", false},
+		{"99", 0, "", true},
+		{"600 Too high", 0, "", true},
+		{"abc", 0, "", true},
+		{"0404", 0, "", true},
+	} {
+		t.Run(tc.status, func(t *testing.T) {
+			at := assert.New(t)
+			code, reason, err := parseCGIStatus(tc.status)
+			at.Equal(tc.isError, err != nil)
+			at.Equal(tc.code, code)
+			at.Equal(tc.reason, reason)
+		})
+	}
+}
+
+func TestCGIHeaders(t *testing.T) {
+	const errorMenu = "3Internal server error.\t\tlocalhost\t70\r\n.\r\n"
+	const forbiddenMenu = "3Forbidden.\t\tlocalhost\t70\r\n.\r\n"
+	for _, tc := range []struct {
+		name     string
+		file     string
+		output   string
+		args     []string
+		response string
+	}{
+		{"NPH by default", "test.cgi", "Status: 404\n\nhello\n", nil, "Status: 404\n\nhello\n"},
+		{"Status", "test.cgi", "Status: 200 OK\r\n\r\nhello\n", []string{"-cgiheaders"}, "hello\n"},
+		{"No headers", "test.cgi", "\nhello\n", []string{"-cgiheaders"}, "hello\n"},
+		{"Other headers", "test.cgi", "Content-Type: text/plain\n\nhello\n", []string{"-cgiheaders"}, "hello\n"},
+		{"No output", "test.cgi", "", []string{"-cgiheaders"}, ""},
+		{"Error menu", "test.cgi", "Status: 404 Not here\n\n", []string{"-cgiheaders"}, "3Not here\t\tlocalhost\t70\r\n.\r\n"},
+		{"Error menu without reason", "test.cgi", "Status: 404\n\n", []string{"-cgiheaders"}, "3Error.\t\tlocalhost\t70\r\n.\r\n"},
+		{"Error text", "test.cgi", "Status: 404 Not here\nX-Gopher-Type: 0\n\n", []string{"-cgiheaders"}, "Not here\r\n"},
+		{"Error with body", "test.cgi", "Status: 404 Not here\n\n3Gone\t\tlocalhost\t70\r\n.\r\n", []string{"-cgiheaders"}, "3Gone\t\tlocalhost\t70\r\n.\r\n"},
+		{"Redirect", "test.cgi", "Location: /hello.txt\n\nignored\n", []string{"-cgiheaders"}, "Hello, world!\n"},
+		{"Redirect with query", "test.cgi", "Location: /query.cgi?a%20b\n\n", []string{"-cgiheaders"}, "a%20b\n"},
+		{"Redirect loop", "test.cgi", "Location: /test.cgi\n\n", []string{"-cgiheaders"}, errorMenu},
+		{"Redirect to another server", "test.cgi", "Location: gopher://example.org/\n\n", []string{"-cgiheaders"}, errorMenu},
+		{"Invalid header", "test.cgi", "hello\n", []string{"-cgiheaders"}, errorMenu},
+		{"Invalid status", "test.cgi", "Status: OK\n\nhello\n", []string{"-cgiheaders"}, errorMenu},
+		{"Unterminated headers", "test.cgi", "Status: 200\n", []string{"-cgiheaders"}, errorMenu},
+		{"Long headers", "test.cgi", "X-Long: " + strings.Repeat("x", maxCGIHeaderBytes) + "\n\n", []string{"-cgiheaders"}, errorMenu},
+		{"Sendfile", "test.cgi", "X-Sendfile: hello.txt\n\nignored\n", []string{"-cgiheaders"}, "Hello, world!\n"},
+		{"Sendfile with status", "test.cgi", "Status: 203\nX-Sendfile: ./hello.txt\n\n", []string{"-cgiheaders"}, "Hello, world!\n"},
+		{"Sendfile absolute path", "test.cgi", "X-Sendfile: @ROOT@/hello.txt\n\n", []string{"-cgiheaders"}, "Hello, world!\n"},
+		{"Sendfile outside the site root", "test.cgi", "X-Sendfile: ../hello.txt\n\n", []string{"-cgiheaders"}, forbiddenMenu},
+		{"Sendfile absolute path outside the site root", "test.cgi", "X-Sendfile: /etc/passwd\n\n", []string{"-cgiheaders"}, forbiddenMenu},
+		{"Sendfile missing file", "test.cgi", "X-Sendfile: missing.txt\n\n", []string{"-cgiheaders"}, "3File not found.\t\tlocalhost\t70\r\n.\r\n"},
+		{"Sendfile directory", "test.cgi", "X-Sendfile: .\n\n", []string{"-cgiheaders"}, forbiddenMenu},
+		{"Sendfile CGI", "test.cgi", "X-Sendfile: query.cgi\n\n", []string{"-cgiheaders"}, forbiddenMenu},
+		{"Sendfile excluded file", "test.cgi", "X-Sendfile: hello.txt\n\n", []string{"-cgiheaders", "-exclude", "txt"}, forbiddenMenu},
+		{"NPH", "nph-test.cgi", "Status: 404\n\nhello\n", []string{"-cgiheaders"}, "Status: 404\n\nhello\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := useTestSite(t)
+			require.NoError(t, os.WriteFile(filepath.Join(root, "output"), []byte(tc.output), 0644))
+			require.NoError(t, os.WriteFile(filepath.Join(root, tc.file), []byte("#!/bin/sh\nsed \"s|@ROOT@|$DOCUMENT_ROOT|\" output\n"), 0755))
+			require.NoError(t, os.WriteFile(filepath.Join(root, "hello.txt"), []byte("Hello, world!\n"), 0644))
+			require.NoError(t, os.WriteFile(filepath.Join(root, "query.cgi"), []byte("#!/bin/sh\necho\necho \"$QUERY_STRING\"\n"), 0755))
+			useConfig(t, tc.args...)
+
+			assert.Equal(t, tc.response, testRequest(t, "/"+tc.file))
+		})
+	}
+}
@@ -0,0 +1,434 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A snapshot of the configuration. A new snapshot is made each time the
+// configuration is loaded (at startup and on SIGHUP). A snapshot must not
+// be modified once it has been made current, so a request may use it
+// while the configuration is being reloaded.
+type config struct {
+	values     map[string]interface{} // same names and types as configMap
+	excluded   map[string]bool
+	listeners  []*listenerConfig
+	configFile string
+
+	// the -listen options as given, before the default is filled in
+	listenOptions []string
+
+	// backends for selector prefixes, and how long to wait to connect
+	// to one and for each read
+	backends       []*backendConfig
+	backendTimeout time.Duration
+
+	// the extension of dynamic CGIs (-dcgi), with the leading dot; empty
+	// if there are none
+	dcgiExt string
+
+	// interpreters (and their arguments) for CGIs without the .cgi
+	// extension, by extension
+	interpreters map[string][]string
+
+	trustedProxies []*net.IPNet
+
+	landlockPaths []string // more paths for -landlock to allow
+
+	// must read a request within this time
+	requestReadTimeout time.Duration
+
+	// must write at least one byte to the client during this time
+	responseProgressTimeout time.Duration
+
+	// a CGI must finish within this time
+	cgiTimeout time.Duration
+
+	// how many CGIs may run at once, in all and for each script (both
+	// large if unlimited), and how long to wait for one to be allowed to
+	cgiMax, cgiScriptMax int
+	cgiWait              time.Duration
+
+	// resource limits for CGIs, and how much a CGI may send (0 if
+	// unlimited)
+	cgiLimits      []processLimit
+	cgiOutputLimit uint64
+
+	// how long a CGI's output is cached (0 if not at all), and how much
+	// may be cached in all
+	cgiCacheTTL  time.Duration
+	cgiCacheSize int
+}
+
+var currentConfig atomic.Pointer[config]
+
+// Start with the default configuration.
+func init() {
+	c, _ := parseConfig(flag.NewFlagSet("", flag.ContinueOnError), nil)
+	c.check()
+	currentConfig.Store(c)
+}
+
+// Get the current configuration.
+func getConfig() *config { return currentConfig.Load() }
+
+func (c *config) Int(name string) int {
+	if u, ok := c.values[name].(*int); ok {
+		return *u
+	}
+	return 0
+}
+func (c *config) Bool(name string) bool {
+	if u, ok := c.values[name].(*bool); ok {
+		return *u
+	}
+	return false
+}
+func (c *config) String(name string) string {
+	switch u := c.values[name].(type) {
+	case *int:
+		return fmt.Sprintf("%d", *u)
+	case *bool:
+		return strconv.FormatBool(*u)
+	case *string:
+		return *u
+	default:
+		return "unsupport type"
+	}
+}
+
+// Make a new configuration from command-line arguments and, if one is
+// named by the -config option, a configuration file. The configuration
+// must be checked before it is used.
+func parseConfig(fs *flag.FlagSet, args []string) (*config, error) {
+	c := &config{
+		values:   make(map[string]interface{}, len(configMap)),
+		excluded: make(map[string]bool, 10),
+
+		interpreters: make(map[string][]string),
+	}
+
+	for name, option := range configMap {
+		switch u := option.value.(type) {
+		case *int:
+			v := new(int)
+			fs.IntVar(v, name, *u, option.usage)
+			c.values[name] = v
+		case *string:
+			v := new(string)
+			fs.StringVar(v, name, *u, option.usage)
+			c.values[name] = v
+		case *bool:
+			v := new(bool)
+			fs.BoolVar(v, name, *u, option.usage)
+			c.values[name] = v
+		default:
+			panic("unsupported type")
+		}
+	}
+	fs.Func("exclude", "Exclude files with the given `extension`.", func(ext string) error {
+		if ext == "" {
+			// don't exclude blank
+			return nil
+		}
+		if !strings.HasPrefix(ext, ".") {
+			// extension is missing the leading dot? that's alright!
+			ext = "." + ext
+		}
+		if strings.Contains(ext[1:], ".") {
+			return fmt.Errorf("extension contains two or more dots")
+		}
+		c.excluded[ext] = true
+		return nil
+	})
+	fs.Func("fastcgi", "Send requests for selectors under a prefix to a\n"+
+		"FastCGI responder, as `/prefix=address`, where address\n"+
+		"is host:port or unix:path. May be given more than once.", func(spec string) error {
+		b, err := parseBackendSpec("fastcgi", spec)
+		if err != nil {
+			return err
+		}
+		c.backends = append(c.backends, b)
+		return nil
+	})
+	fs.Func("scgi", "Send requests for selectors under a prefix to an\n"+
+		"SCGI server, as `/prefix=address`, where address is\n"+
+		"host:port or unix:path. May be given more than once.", func(spec string) error {
+		b, err := parseBackendSpec("scgi", spec)
+		if err != nil {
+			return err
+		}
+		c.backends = append(c.backends, b)
+		return nil
+	})
+	fs.Func("interpreter", "Run files with the given extension as CGIs with an interpreter,\n"+
+		"as `.ext=program`. May be given more than once.", func(spec string) error {
+		ext, program, ok := strings.Cut(spec, "=")
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		args := strings.Fields(program)
+		if !ok || len(args) == 0 || len(ext) == 1 {
+			return fmt.Errorf("must be of the form .ext=program")
+		}
+		if strings.Contains(ext[1:], ".") {
+			return fmt.Errorf("extension contains two or more dots")
+		}
+		if ext == cgiExt {
+			return fmt.Errorf("%s files are always run directly", cgiExt)
+		}
+		c.interpreters[ext] = args
+		return nil
+	})
+	fs.Func("listen", "The `[host:]port[,option...]` to listen on.\n"+
+		"May be given more than once. (default \""+defaultListen+"\")", func(spec string) error {
+		l, err := parseListenSpec(spec)
+		if err != nil {
+			return err
+		}
+		c.listeners = append(c.listeners, l)
+		c.listenOptions = append(c.listenOptions, spec)
+		return nil
+	})
+	fs.Func("proxytrust", "Accept PROXY protocol headers on proxy listeners from\n"+
+		"the given `address` or CIDR block. May be given more than once.", func(s string) error {
+		ipNet, err := parseTrustedProxy(s)
+		if err != nil {
+			return err
+		}
+		c.trustedProxies = append(c.trustedProxies, ipNet)
+		return nil
+	})
+	fs.Func("landlockallow", "With -landlock, also allow reading and executing\n"+
+		"files under `path`. May be given more than once.", func(path string) error {
+		if path == "" {
+			return fmt.Errorf("missing path")
+		}
+		c.landlockPaths = append(c.landlockPaths, path)
+		return nil
+	})
+	fs.StringVar(&c.configFile, "config", "", "Read options from the configuration `file`.\n"+
+		"Options given on the command line take precedence.")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if c.configFile != "" {
+		if err := loadConfigFile(fs, c.configFile); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Check the configuration for errors and fill in derived values.
+func (c *config) check() error {
+	if c.Int("maxconn") < 1 {
+		return fmt.Errorf("maxconn must be > 0")
+	}
+
+	r := c.Int("rtmo")
+	if r < 0 {
+		return fmt.Errorf("rtmo must be >= 0")
+	}
+	c.requestReadTimeout = time.Duration(r) * time.Second
+
+	w := c.Int("wtmo")
+	if w < 0 {
+		return fmt.Errorf("wtmo must be >= 0")
+	}
+	c.responseProgressTimeout = time.Duration(w) * time.Second
+
+	cg := c.Int("cgitmo")
+	if cg < 0 {
+		return fmt.Errorf("cgitmo must be >= 0")
+	}
+	c.cgiTimeout = time.Duration(cg) * time.Second
+
+	for _, name := range []string{"backendtmo", "cgimax", "cgiscriptmax", "cgiwait"} {
+		if c.Int(name) < 0 {
+			return fmt.Errorf("%s must be >= 0", name)
+		}
+	}
+	c.cgiMax, c.cgiScriptMax = c.Int("cgimax"), c.Int("cgiscriptmax")
+	if c.cgiMax == 0 {
+		c.cgiMax = math.MaxInt32
+	}
+	if c.cgiScriptMax == 0 {
+		c.cgiScriptMax = math.MaxInt32
+	}
+	c.cgiWait = time.Duration(c.Int("cgiwait")) * time.Second
+	c.backendTimeout = time.Duration(c.Int("backendtmo")) * time.Second
+
+	c.dcgiExt = c.String("dcgi")
+	if c.dcgiExt != "" && !strings.HasPrefix(c.dcgiExt, ".") {
+		c.dcgiExt = "." + c.dcgiExt
+	}
+	if ext := c.dcgiExt; ext == "." || ext != "" && strings.Contains(ext[1:], ".") {
+		return fmt.Errorf("dcgi must be an extension with one dot")
+	}
+	if c.dcgiExt == cgiExt {
+		return fmt.Errorf("dcgi cannot be %s", cgiExt)
+	}
+
+	c.cgiLimits = nil
+	for _, l := range cgiLimitOptions {
+		v := c.Int(l.name)
+		if v < 0 {
+			return fmt.Errorf("%s must be >= 0", l.name)
+		}
+		if v == 0 {
+			continue
+		}
+		resource, ok := processLimitResources[l.name]
+		if !ok {
+			return fmt.Errorf("%s is not supported on this system", l.name)
+		}
+		c.cgiLimits = append(c.cgiLimits, processLimit{resource, uint64(v) * l.unit})
+	}
+	// the limits are set by running CGIs through this program, which
+	// can't be run within the new root
+	if len(c.cgiLimits) != 0 && c.Bool("chroot") {
+		return fmt.Errorf("CGI resource limits cannot be used with -chroot")
+	}
+	o := c.Int("cgioutput")
+	if o < 0 {
+		return fmt.Errorf("cgioutput must be >= 0")
+	}
+	c.cgiOutputLimit = uint64(o) << 20
+
+	for _, name := range []string{"cgicache", "cgicachesize"} {
+		if c.Int(name) < 0 {
+			return fmt.Errorf("%s must be >= 0", name)
+		}
+	}
+	c.cgiCacheTTL = time.Duration(c.Int("cgicache")) * time.Second
+	c.cgiCacheSize = c.Int("cgicachesize") << 20
+
+	if c.Int("errorlogmax") < 0 {
+		return fmt.Errorf("errorlogmax must be >= 0")
+	}
+
+	if p := c.Int("serverport"); p < 0 || 65535 < p {
+		return fmt.Errorf("serverport must be between 0 and 65535")
+	}
+
+	for _, l := range c.listeners {
+		if l.tls && (c.String("tlscert") == "" || c.String("tlskey") == "") {
+			return fmt.Errorf("listen %s: tls requires -tlscert and -tlskey", l.spec)
+		}
+		if l.proxy && len(c.trustedProxies) == 0 {
+			return fmt.Errorf("listen %s: proxy requires -proxytrust", l.spec)
+		}
+	}
+
+	if c.Bool("inetd") {
+		if len(c.listeners) != 0 {
+			return fmt.Errorf("inetd and listen cannot be used together")
+		}
+		return nil
+	}
+
+	if len(c.listeners) == 0 {
+		spec := defaultListen
+		if socketActivated() {
+			spec = "systemd"
+		}
+		l, err := parseListenSpec(spec)
+		if err != nil {
+			return err
+		}
+		c.listeners = []*listenerConfig{l}
+	}
+	return nil
+}
+
+// The -listen options as given, for comparing configurations. (The
+// default listener filled in by check is left out, since a configuration
+// that hasn't been checked doesn't have it yet.)
+func (c *config) listenSpecs() string {
+	return strings.Join(c.listenOptions, " ")
+}
+
+// Read options from a configuration file.
+//
+// Each line of the file has the form `name = value`, where name is the
+// name of a command-line option without the leading dash. The value may
+// be enclosed in double quotes (with Go string escapes) to keep leading
+// or trailing spaces. Blank lines and lines starting with `#` are
+// ignored. An option that may be given more than once on the command
+// line (such as exclude) may also be given more than once in the file.
+//
+// Options given on the command line take precedence over the file, so
+// any option already set in fs is skipped.
+func loadConfigFile(fs *flag.FlagSet, path string) error {
+	setByFlag := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { setByFlag[f.Name] = true })
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		name, value, ok, err := parseConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+		if !ok {
+			continue
+		}
+		if fs.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("%s:%d: unknown option %q", path, lineNum, name)
+		}
+		if setByFlag[name] {
+			continue
+		}
+		if err = fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value %q for option %s: %v", path, lineNum, value, name, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Parse a single line of a configuration file. ok is false if the line
+// is blank or a comment.
+func parseConfigLine(line string) (name, value string, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return
+	}
+
+	name, value, found := strings.Cut(line, "=")
+	if !found {
+		err = fmt.Errorf("expected `name = value`")
+		return
+	}
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if name == "" {
+		err = fmt.Errorf("missing option name")
+		return
+	}
+
+	if strings.HasPrefix(value, `"`) {
+		value, err = strconv.Unquote(value)
+		if err != nil {
+			err = fmt.Errorf("badly quoted value for option %s", name)
+			return
+		}
+	}
+	ok = true
+	return
+}
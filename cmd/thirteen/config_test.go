@@ -0,0 +1,209 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"flag"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		args     []string
+		file     string
+		desc     string
+		maxconn  int
+		excludes []string
+		err      string
+	}{
+		{
+			"Empty",
+			nil,
+			"",
+			"", 1000, nil, "",
+		},
+		{
+			"Comments and blank lines",
+			nil,
+			"# a comment\n\n   # another comment\ndesc = My server\n",
+			"My server", 1000, nil, "",
+		},
+		{
+			"Quoted value",
+			nil,
+			"desc = \"  spaces\\tand tabs  \"\n",
+			"  spaces\tand tabs  ", 1000, nil, "",
+		},
+		{
+			"Int value",
+			nil,
+			"maxconn=10\n",
+			"", 10, nil, "",
+		},
+		{
+			"Repeated option",
+			nil,
+			"exclude = .a\nexclude = .b\n",
+			"", 1000, []string{".a", ".b"}, "",
+		},
+		{
+			"Command line takes precedence",
+			[]string{"-desc", "flag", "-exclude", ".c"},
+			"desc = file\nmaxconn = 5\nexclude = .a\n",
+			"flag", 5, []string{".c"}, "",
+		},
+		{
+			"Unknown option",
+			nil,
+			"desc = ok\nbogus = 1\n",
+			"", 1000, nil, `:2: unknown option "bogus"`,
+		},
+		{
+			"Config option in file",
+			nil,
+			"config = other.conf\n",
+			"", 1000, nil, `:1: unknown option "config"`,
+		},
+		{
+			"Missing equals sign",
+			nil,
+			"\n\ndesc My server\n",
+			"", 1000, nil, ":3: expected `name = value`",
+		},
+		{
+			"Missing name",
+			nil,
+			"= value\n",
+			"", 1000, nil, ":1: missing option name",
+		},
+		{
+			"Bad quotes",
+			nil,
+			"desc = \"unterminated\n",
+			"", 1000, nil, ":1: badly quoted value for option desc",
+		},
+		{
+			"Bad int value",
+			nil,
+			"maxconn = many\n",
+			"", 1000, nil, `:1: invalid value "many" for option maxconn`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			at := assert.New(t)
+
+			var excludes []string
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			desc := fs.String("desc", "", "")
+			maxconn := fs.Int("maxconn", 1000, "")
+			fs.Func("exclude", "", func(ext string) error { excludes = append(excludes, ext); return nil })
+			fs.String("config", "", "")
+			at.NoError(fs.Parse(tc.args))
+
+			path := filepath.Join(t.TempDir(), "thirteen.conf")
+			at.NoError(os.WriteFile(path, []byte(tc.file), 0644))
+
+			err := loadConfigFile(fs, path)
+			if tc.err != "" {
+				if at.Error(err) {
+					at.True(strings.HasPrefix(err.Error(), path+tc.err), err.Error())
+				}
+				return
+			}
+			at.NoError(err)
+			at.Equal(tc.desc, *desc)
+			at.Equal(tc.maxconn, *maxconn)
+			at.Equal(tc.excludes, excludes)
+		})
+	}
+}
+
+func TestLoadConfigFileMissing(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	err := loadConfigFile(fs, filepath.Join(t.TempDir(), "missing.conf"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestInterpreterOption(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		args         []string
+		interpreters map[string][]string
+		isError      bool
+	}{
+		{"None", nil, map[string][]string{}, false},
+		{"Extensions", []string{"-interpreter", ".py=python3", "-interpreter", "pl=/usr/bin/perl -T"}, map[string][]string{".py": {"python3"}, ".pl": {"/usr/bin/perl", "-T"}}, false},
+		{"No program", []string{"-interpreter", ".py="}, nil, true},
+		{"No extension", []string{"-interpreter", "=python3"}, nil, true},
+		{"Two dots", []string{"-interpreter", ".tar.py=python3"}, nil, true},
+		{"CGI extension", []string{"-interpreter", ".cgi=sh"}, nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), tc.args)
+			assert.Equal(t, tc.isError, err != nil, "%v", err)
+			if err == nil {
+				assert.Equal(t, tc.interpreters, c.interpreters)
+			}
+		})
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	at := assert.New(t)
+	configFile := filepath.Join(t.TempDir(), "thirteen.conf")
+	writeConfig := func(s string) {
+		require.NoError(t, os.WriteFile(configFile, []byte(s), 0644))
+	}
+
+	oldArgs := os.Args
+	os.Args = []string{"thirteen", "-config", configFile}
+	useConnLimit(t)
+	t.Cleanup(func() {
+		os.Args = oldArgs
+		cgiLimit.setLimit(math.MaxInt32)
+	})
+	writeConfig("maxconn = 10\ncgimax = 2\nroot = /srv/a\nlisten = 7070\nlandlockallow = /usr/lib\n")
+	useConfig(t, os.Args[1:]...)
+
+	// changes take effect, except to startup options
+	writeConfig("maxconn = 20\ncgimax = 3\nexclude = bak\nroot = /srv/b\nlisten = 7071\nlandlockallow = /opt\n")
+	log := captureLog(t, reloadConfig)
+	at.Contains(log, "reload: ignoring change to -root (restart required)")
+	at.Contains(log, "reload: ignoring change to -listen (restart required)")
+	at.Contains(log, "reload: ignoring change to -landlockallow (restart required)")
+	at.Contains(log, "reload: configuration reloaded")
+	c := getConfig()
+	at.Equal("/srv/a", c.String("root"))
+	at.Equal("7070", c.listenSpecs())
+	at.Equal([]string{"/usr/lib"}, c.landlockPaths)
+	at.Equal(20, c.Int("maxconn"))
+	at.Equal(20, connLimit.limit)
+	at.Equal(3, cgiLimit.limit)
+	at.True(c.excluded[".bak"])
+
+	// an invalid configuration is not used
+	for _, file := range []string{"cgimax = -1\n", "nosuchoption = 1\n"} {
+		writeConfig(file)
+		log = captureLog(t, reloadConfig)
+		at.Contains(log, "keeping current configuration")
+		at.Same(c, getConfig())
+		at.Equal(20, connLimit.limit)
+		at.Equal(3, cgiLimit.limit)
+	}
+
+	// the default listener isn't a change to -listen
+	writeConfig("maxconn = 10\n")
+	useConfig(t, os.Args[1:]...)
+	log = captureLog(t, reloadConfig)
+	at.NotContains(log, "-listen")
+	at.Contains(log, "reload: configuration reloaded")
+	at.Equal(defaultListen, getConfig().listeners[0].spec)
+}
@@ -0,0 +1,95 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// The error log, where CGIs' standard error goes: the file named by
+// -errorlog, or standard error.
+var errorLog = struct {
+	sync.Mutex
+	w io.Writer
+}{w: os.Stderr}
+
+// Open the file named by -errorlog (again, so a rotated log is replaced by
+// a new file) or go back to standard error. The current log is kept on
+// error.
+func openErrorLog() error {
+	path := configString("errorlog")
+	var w io.Writer = os.Stderr
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+
+	errorLog.Lock()
+	old := errorLog.w
+	errorLog.w = w
+	errorLog.Unlock()
+	if f, ok := old.(*os.File); ok && f != os.Stderr {
+		f.Close()
+	}
+	return nil
+}
+
+// Write a line to the error log about a request.
+func errorLogf(c *client, script, format string, a ...interface{}) {
+	addr := c.addr
+	if addr == "" {
+		addr = "-"
+	}
+	line := fmt.Sprintf("%s %s %s %s: %s\n", time.Now().Format(time.RFC3339), script, addr, c.id, fmt.Sprintf(format, a...))
+	errorLog.Lock()
+	io.WriteString(errorLog.w, line)
+	errorLog.Unlock()
+}
+
+// Copy a CGI's standard error to the error log, line by line, until r
+// reaches EOF. Only the first -errorlogmax kilobytes are logged (if not
+// 0); the rest is read and discarded so the CGI doesn't block.
+func logCGIStderr(r io.ReadCloser, c *client, script string) {
+	defer r.Close()
+	limit := configInt("errorlogmax") << 10
+	logged, truncated := 0, false
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(line) != 0 && !truncated {
+			if limit != 0 && logged+len(line) > limit {
+				line = line[:limit-logged]
+				truncated = true
+			}
+			logged += len(line)
+			if len(line) != 0 {
+				errorLogf(c, script, "%s", bytes.TrimRight(line, "\r\n"))
+			}
+			if truncated {
+				errorLogf(c, script, "(standard error truncated after %d bytes)", limit)
+			}
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return
+		}
+	}
+}
+
+// Make a new random request ID, for matching error log lines with the
+// access log line for the same request.
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,106 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Send the error log to a buffer for the rest of the test.
+func captureErrorLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	errorLog.Lock()
+	old := errorLog.w
+	errorLog.w = &buf
+	errorLog.Unlock()
+	t.Cleanup(func() {
+		errorLog.Lock()
+		errorLog.w = old
+		errorLog.Unlock()
+	})
+	return &buf
+}
+
+func TestLogCGIStderr(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		max    string
+		stderr string
+		lines  []string
+	}{
+		{"Empty", "64", "", nil},
+		{"Lines", "64", "first\r\nsecond\n\nlast without newline", []string{"first", "second", "", "last without newline"}},
+		{"Truncated", "1", strings.Repeat("x", 1000) + "\n" + strings.Repeat("y", 100) + "\nmore\n", []string{
+			strings.Repeat("x", 1000),
+			strings.Repeat("y", 23),
+			"(standard error truncated after 1024 bytes)",
+		}},
+		{"Exactly at limit", "1", strings.Repeat("x", 1023) + "\n", []string{strings.Repeat("x", 1023)}},
+		{"No limit", "0", strings.Repeat("x", 5000) + "\n", []string{strings.Repeat("x", 4096), strings.Repeat("x", 904)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			at := assert.New(t)
+			useConfig(t, "-errorlogmax", tc.max)
+			buf := captureErrorLog(t)
+
+			c := &client{addr: "192.0.2.1", id: "0123456789abcdef"}
+			logCGIStderr(io.NopCloser(strings.NewReader(tc.stderr)), c, "/srv/gopher/test.cgi")
+
+			var lines []string
+			for _, line := range strings.SplitAfter(buf.String(), "\n") {
+				if line == "" {
+					continue
+				}
+				_, rest, _ := strings.Cut(line, " ")
+				at.True(strings.HasPrefix(rest, "/srv/gopher/test.cgi 192.0.2.1 0123456789abcdef: "), line)
+				lines = append(lines, strings.TrimSuffix(strings.TrimPrefix(rest, "/srv/gopher/test.cgi 192.0.2.1 0123456789abcdef: "), "\n"))
+			}
+			at.Equal(tc.lines, lines)
+		})
+	}
+}
+
+func TestOpenErrorLog(t *testing.T) {
+	at := assert.New(t)
+	t.Cleanup(func() {
+		errorLog.Lock()
+		errorLog.w = os.Stderr
+		errorLog.Unlock()
+	})
+
+	path := filepath.Join(t.TempDir(), "error.log")
+	useConfig(t, "-errorlog", path)
+	require.NoError(t, openErrorLog())
+	errorLogf(&client{id: "id"}, "/test.cgi", "hello")
+
+	// reopening (as after the log has been rotated) starts a new file
+	require.NoError(t, os.Rename(path, path+".1"))
+	require.NoError(t, openErrorLog())
+	errorLogf(&client{id: "id"}, "/test.cgi", "again")
+
+	rotated, err := os.ReadFile(path + ".1")
+	at.NoError(err)
+	at.Contains(string(rotated), " /test.cgi - id: hello\n")
+	current, err := os.ReadFile(path)
+	at.NoError(err)
+	at.Contains(string(current), " /test.cgi - id: again\n")
+	at.NotContains(string(current), "hello")
+
+	useConfig(t, "-errorlog", filepath.Join(path, "not a directory", "error.log"))
+	at.Error(openErrorLog())
+}
+
+func TestRequestID(t *testing.T) {
+	at := assert.New(t)
+	a, b := newRequestID(), newRequestID()
+	at.Len(a, 16)
+	at.NotEqual(a, b)
+}
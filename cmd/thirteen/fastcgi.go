@@ -0,0 +1,195 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// FastCGI record types and other constants (see the FastCGI
+// specification).
+const (
+	fcgiVersion = 1
+
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiResponder = 1
+
+	fcgiRequestID = 1 // only one request is sent on each connection
+
+	fcgiMaxContent = 65535
+)
+
+// A FastCGI record header.
+type fcgiHeader struct {
+	Version       uint8
+	Type          uint8
+	RequestID     uint16
+	ContentLength uint16
+	PaddingLength uint8
+	Reserved      uint8
+}
+
+// Write a FastCGI record (without padding).
+func writeFastCGIRecord(w io.Writer, recType uint8, content []byte) error {
+	h := fcgiHeader{Version: fcgiVersion, Type: recType, RequestID: fcgiRequestID, ContentLength: uint16(len(content))}
+	if err := binary.Write(w, binary.BigEndian, h); err != nil {
+		return err
+	}
+	_, err := w.Write(content)
+	return err
+}
+
+// Read a FastCGI record, skipping its padding.
+func readFastCGIRecord(r io.Reader) (recType uint8, content []byte, err error) {
+	var h fcgiHeader
+	if err = binary.Read(r, binary.BigEndian, &h); err != nil {
+		return
+	}
+	if h.Version != fcgiVersion {
+		return 0, nil, fmt.Errorf("unsupported FastCGI version %d", h.Version)
+	}
+	content = make([]byte, int(h.ContentLength)+int(h.PaddingLength))
+	if _, err = io.ReadFull(r, content); err != nil {
+		return
+	}
+	return h.Type, content[:h.ContentLength], nil
+}
+
+// Encode a FastCGI name-value pair length.
+func appendFastCGILength(b []byte, n int) []byte {
+	if n < 0x80 {
+		return append(b, byte(n))
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(n)|1<<31)
+}
+
+// Send a request to a FastCGI responder: the environment (`NAME=value`
+// strings) as parameters, and an empty standard input.
+func writeFastCGIRequest(w io.Writer, env []string) error {
+	bw := bufio.NewWriter(w)
+
+	// role, flags (don't keep the connection open), reserved
+	begin := []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}
+	if err := writeFastCGIRecord(bw, fcgiBeginRequest, begin); err != nil {
+		return err
+	}
+
+	var params []byte
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		params = appendFastCGILength(params, len(name))
+		params = appendFastCGILength(params, len(value))
+		params = append(params, name...)
+		params = append(params, value...)
+	}
+	for len(params) != 0 {
+		n := len(params)
+		if n > fcgiMaxContent {
+			n = fcgiMaxContent
+		}
+		if err := writeFastCGIRecord(bw, fcgiParams, params[:n]); err != nil {
+			return err
+		}
+		params = params[n:]
+	}
+	if err := writeFastCGIRecord(bw, fcgiParams, nil); err != nil {
+		return err
+	}
+	if err := writeFastCGIRecord(bw, fcgiStdin, nil); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Run a request with a FastCGI responder and return a response that
+// streams its standard output. Its standard error goes to the error log.
+func runFastCGI(client *client, b *backendConfig, selector, scriptName, pathInfo, query, search string) response {
+	release, busyErr := acquireCGI(b.spec)
+	if busyErr != nil {
+		return makeErrorResponse(client, busyErr)
+	}
+
+	conn, err := dialBackend(b)
+	if err != nil {
+		logf("%v: %v", b, err)
+		release()
+		return makeErrorResponse(client, internalServerErrorError)
+	}
+
+	env := backendEnv(client, selector, scriptName, pathInfo, query, search)
+	if err = writeFastCGIRequest(conn, env); err != nil {
+		logf("%v: %v", b, err)
+		conn.Close()
+		release()
+		return makeErrorResponse(client, internalServerErrorError)
+	}
+
+	stderr, stderrWriter := io.Pipe()
+	go logCGIStderr(stderr, client, b.spec)
+
+	return response{&fastCGIReader{
+		backend: b,
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		stderr:  stderrWriter,
+		release: release,
+	}, okStatus, nil}
+}
+
+// Reads a FastCGI responder's standard output, up to the end of the
+// request.
+type fastCGIReader struct {
+	backend *backendConfig
+	conn    net.Conn
+	r       *bufio.Reader
+	stdout  []byte // not yet read
+	stderr  *io.PipeWriter
+	done    bool
+
+	closeOnce sync.Once
+	release   func()
+}
+
+func (f *fastCGIReader) Read(p []byte) (int, error) {
+	for len(f.stdout) == 0 {
+		if f.done {
+			return 0, io.EOF
+		}
+		recType, content, err := readFastCGIRecord(f.r)
+		if err != nil {
+			logf("%v: %v", f.backend, err)
+			return 0, err
+		}
+		switch recType {
+		case fcgiStdout:
+			f.stdout = content
+		case fcgiStderr:
+			f.stderr.Write(content)
+		case fcgiEndRequest:
+			f.done = true
+		}
+	}
+	n := copy(p, f.stdout)
+	f.stdout = f.stdout[n:]
+	return n, nil
+}
+
+func (f *fastCGIReader) Close() error {
+	f.closeOnce.Do(func() {
+		f.stderr.Close()
+		f.release()
+	})
+	return f.conn.Close()
+}
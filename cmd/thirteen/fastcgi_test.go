@@ -0,0 +1,174 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBackendSpec(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		spec    string
+		prefix  string
+		network string
+		address string
+		isError bool
+	}{
+		{"TCP", "/app=127.0.0.1:9000", "/app", "tcp", "127.0.0.1:9000", false},
+		{"Unix", "/app/=unix:/run/app.sock", "/app", "unix", "/run/app.sock", false},
+		{"Root", "/=localhost:9000", "", "tcp", "localhost:9000", false},
+		{"Normalized", "//a/./b/=localhost:9000", "/a/b", "tcp", "localhost:9000", false},
+		{"No slash", "app=localhost:9000", "", "", "", true},
+		{"No address", "/app", "", "", "", true},
+		{"No port", "/app=localhost", "", "", "", true},
+		{"No unix path", "/app=unix:", "", "", "", true},
+		{"Dot dot", "/..=localhost:9000", "", "", "", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			at := assert.New(t)
+			b, err := parseBackendSpec("fastcgi", tc.spec)
+			at.Equal(tc.isError, err != nil, "%v", err)
+			if err == nil {
+				at.Equal(tc.prefix, b.prefix)
+				at.Equal(tc.network, b.network)
+				at.Equal(tc.address, b.address)
+			}
+		})
+	}
+}
+
+func TestFindBackend(t *testing.T) {
+	useConfig(t, "-fastcgi", "/app=localhost:9000", "-fastcgi", "/app/admin=localhost:9001")
+	for _, tc := range []struct {
+		path       string
+		address    string
+		scriptName string
+		pathInfo   string
+	}{
+		{"/app", "localhost:9000", "/app", ""},
+		{"/app/", "localhost:9000", "/app", "/"},
+		{"/app/menu", "localhost:9000", "/app", "/menu"},
+		{"/app/admin/users", "localhost:9001", "/app/admin", "/users"},
+		{"/application", "", "", ""},
+		{"/", "", "", ""},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			at := assert.New(t)
+			b, scriptName, pathInfo := getConfig().findBackend(tc.path)
+			if tc.address == "" {
+				at.Nil(b)
+				return
+			}
+			if at.NotNil(b) {
+				at.Equal(tc.address, b.address)
+			}
+			at.Equal(tc.scriptName, scriptName)
+			at.Equal(tc.pathInfo, pathInfo)
+		})
+	}
+}
+
+// Decode FastCGI name-value pairs.
+func parseFastCGIParams(b []byte) map[string]string {
+	length := func() int {
+		if b[0] < 0x80 {
+			n := int(b[0])
+			b = b[1:]
+			return n
+		}
+		n := int(binary.BigEndian.Uint32(b) &^ (1 << 31))
+		b = b[4:]
+		return n
+	}
+	params := make(map[string]string)
+	for len(b) != 0 {
+		nameLen := length()
+		valueLen := length()
+		params[string(b[:nameLen])] = string(b[nameLen : nameLen+valueLen])
+		b = b[nameLen+valueLen:]
+	}
+	return params
+}
+
+// A FastCGI responder for testing, which sends some of the parameters it
+// was given, and a line to standard error.
+func serveTestFastCGI(t *testing.T, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			var params []byte
+			for {
+				recType, content, err := readFastCGIRecord(r)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if recType == fcgiParams {
+					params = append(params, content...)
+				}
+				if recType == fcgiStdin && len(content) == 0 {
+					break
+				}
+			}
+			p := parseFastCGIParams(params)
+			out := fmt.Sprintf("SCRIPT_NAME=%s\nPATH_INFO=%s\nQUERY_STRING=%d bytes\nREQUEST_ID=%t\n",
+				p["SCRIPT_NAME"], p["PATH_INFO"], len(p["QUERY_STRING"]), p["REQUEST_ID"] != "")
+			// a record at a time, to test reading across records
+			for _, line := range strings.SplitAfter(out, "\n") {
+				writeFastCGIRecord(conn, fcgiStdout, []byte(line))
+			}
+			writeFastCGIRecord(conn, fcgiStderr, []byte("a warning\n"))
+			writeFastCGIRecord(conn, fcgiStdout, nil)
+			writeFastCGIRecord(conn, fcgiStderr, nil)
+			writeFastCGIRecord(conn, fcgiEndRequest, []byte{0, 0, 0, 0, 0, 0, 0, 0})
+		}()
+	}
+}
+
+func TestFastCGI(t *testing.T) {
+	at := assert.New(t)
+
+	useConnLimit(t)
+
+	sock := filepath.Join(t.TempDir(), "fcgi.sock")
+	l, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	defer l.Close()
+	go serveTestFastCGI(t, l)
+
+	logFile := filepath.Join(t.TempDir(), "error.log")
+	useConfig(t, "-fastcgi", "/app=unix:"+sock, "-errorlog", logFile)
+	require.NoError(t, openErrorLog())
+	t.Cleanup(func() { openErrorLog() })
+
+	query := strings.Repeat("q", 300)
+	at.Equal("SCRIPT_NAME=/app\nPATH_INFO=/menu\nQUERY_STRING=300 bytes\nREQUEST_ID=true\n", testRequest(t, "/app/menu?"+query))
+
+	// nothing is listening
+	l.Close()
+	os.Remove(sock)
+	at.Equal("3Internal server error.\t\tlocalhost\t70\r\n.\r\n", testRequest(t, "/app"))
+
+	// (standard error is logged as it arrives)
+	at.Eventually(func() bool {
+		log, _ := os.ReadFile(logFile)
+		return strings.Contains(string(log), " /app=unix:"+sock+" pipe ") && strings.Contains(string(log), ": a warning\n")
+	}, time.Second, 10*time.Millisecond)
+}
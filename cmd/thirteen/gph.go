@@ -0,0 +1,94 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// Render a line of GPH (geomyidae's menu format) as a menu line. A line
+// of the form `[type|description|selector|host|port]` is an item; a host
+// of "server" or a port of "port" (or either left out) means this server.
+// Any other line is text, with a leading "t" removed (so a text line can
+// start with "["). Tabs become spaces.
+func renderGPHLine(line, host, port string) string {
+	line = strings.ReplaceAll(strings.TrimRight(line, "\r\n"), "\t", " ")
+	if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+		fields := splitGPHFields(line[1 : len(line)-1])
+		if len(fields) >= 3 && len(fields) <= 5 && len(fields[0]) == 1 {
+			itemHost, itemPort := host, port
+			if len(fields) >= 4 && fields[3] != "" && fields[3] != "server" {
+				itemHost = fields[3]
+			}
+			if len(fields) == 5 && fields[4] != "" && fields[4] != "port" {
+				itemPort = fields[4]
+			}
+			return makeMenuLine(fields[0][0], fields[1], fields[2], itemHost, itemPort)
+		}
+	}
+	return makeMenuLine('i', strings.TrimPrefix(line, "t"), "", host, port)
+}
+
+// Split the fields of a GPH item on "|". A "\|" is a "|" within a field.
+func splitGPHFields(s string) []string {
+	var fields []string
+	var field strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == '|':
+			field.WriteByte('|')
+			i++
+		case s[i] == '|':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(s[i])
+		}
+	}
+	return append(fields, field.String())
+}
+
+// Reads a dynamic CGI's standard output as GPH and renders it as a menu,
+// ending with the terminating "." line. If the CGI writes nothing, there
+// is nothing to read (not even the "."), so a CGI that fails without
+// output gets an error menu like any other.
+type gphReader struct {
+	src        io.ReadCloser
+	r          *bufio.Reader
+	host, port string
+	buf        []byte // rendered and not yet read
+	rendered   bool   // a line has been rendered
+	err        error  // from src
+}
+
+func newGPHReader(src io.ReadCloser, host, port string) *gphReader {
+	return &gphReader{src: src, r: bufio.NewReader(src), host: host, port: port}
+}
+
+func (g *gphReader) Read(p []byte) (int, error) {
+	for len(g.buf) == 0 {
+		if g.err != nil {
+			return 0, g.err
+		}
+		line, err := g.r.ReadString('\n')
+		if line != "" {
+			g.buf = append(g.buf, renderGPHLine(line, g.host, g.port)...)
+			g.rendered = true
+		}
+		if err != nil {
+			g.err = err
+			if err == io.EOF && g.rendered {
+				g.buf = append(g.buf, ".\r\n"...)
+			}
+		}
+	}
+	n := copy(p, g.buf)
+	g.buf = g.buf[n:]
+	return n, nil
+}
+
+func (g *gphReader) Close() error {
+	return g.src.Close()
+}
@@ -0,0 +1,73 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderGPHLine(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		line string
+		menu string
+	}{
+		{"Text", "Hello, world!\n", "iHello, world!\t\tlocalhost\t70\r\n"},
+		{"Empty line", "\n", "i\t\tlocalhost\t70\r\n"},
+		{"CRLF", "Hello\r\n", "iHello\t\tlocalhost\t70\r\n"},
+		{"Tab", "a\tb\n", "ia b\t\tlocalhost\t70\r\n"},
+		{"Escaped text", "t[not a link]\n", "i[not a link]\t\tlocalhost\t70\r\n"},
+		{"Item", "[1|Phlog|/phlog|server|port]\n", "1Phlog\t/phlog\tlocalhost\t70\r\n"},
+		{"Item on another server", "[0|About|/about.txt|example.org|7070]", "0About\t/about.txt\texample.org\t7070\r\n"},
+		{"Item without host and port", "[0|About|/about.txt]", "0About\t/about.txt\tlocalhost\t70\r\n"},
+		{"Item with empty host and port", "[0|About|/about.txt||]", "0About\t/about.txt\tlocalhost\t70\r\n"},
+		{"Escaped pipe", "[h|a \\| b|URL:https://example.org/|server|port]", "ha | b\tURL:https://example.org/\tlocalhost\t70\r\n"},
+		{"Too few fields", "[1|Phlog]", "i[1|Phlog]\t\tlocalhost\t70\r\n"},
+		{"Too many fields", "[1|a|b|c|d|e]", "i[1|a|b|c|d|e]\t\tlocalhost\t70\r\n"},
+		{"Long type", "[10|a|b|server|port]", "i[10|a|b|server|port]\t\tlocalhost\t70\r\n"},
+		{"Unterminated", "[1|a|b|server|port", "i[1|a|b|server|port\t\tlocalhost\t70\r\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.menu, renderGPHLine(tc.line, "localhost", "70"))
+		})
+	}
+}
+
+func TestGPHReader(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		gph  string
+		menu string
+	}{
+		{"Empty", "", ""},
+		{"One line", "Hi", "iHi\t\th\t1\r\n.\r\n"},
+		{"Two lines", "Hi\n[1|Up|/|server|port]\n", "iHi\t\th\t1\r\n1Up\t/\th\t1\r\n.\r\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			at := assert.New(t)
+			menu, err := io.ReadAll(newGPHReader(io.NopCloser(strings.NewReader(tc.gph)), "h", "1"))
+			at.NoError(err)
+			at.Equal(tc.menu, string(menu))
+		})
+	}
+}
+
+func TestDynamicCGI(t *testing.T) {
+	root := useTestSite(t)
+	script := "#!/bin/sh\necho 'Results for '\"$2\"\necho '[0|Read me|/readme.txt|server|port]'\n"
+	require.NoError(t, os.WriteFile(filepath.Join(root, "search.dcgi"), []byte(script), 0755))
+
+	// not a CGI unless -dcgi is given
+	useConfig(t)
+	assert.Equal(t, script, testRequest(t, "/search.dcgi?q"))
+
+	useConfig(t, "-dcgi", "dcgi")
+	assert.Equal(t, "iResults for q\t\tlocalhost\t70\r\n0Read me\t/readme.txt\tlocalhost\t70\r\n.\r\n", testRequest(t, "/search.dcgi?q"))
+}
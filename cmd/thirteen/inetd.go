@@ -0,0 +1,80 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Serve a single request read from in, writing the response to out, as
+// for a server started by inetd, xinetd, or tcpserver.
+func serveInetd(in, out *os.File) {
+	conn, lc := inetdConn(in, out)
+	connLimit.acquire(nil)
+	openConns.Add(1)
+	openConnCount.Add(1)
+	handleConn(conn, lc)
+}
+
+// Make a connection from in and out. If in is a socket (as with inetd and
+// xinetd), the connection is the socket itself. Otherwise (as with
+// tcpserver) the client's address is taken from the environment.
+func inetdConn(in, out *os.File) (net.Conn, *listenerConfig) {
+	lc := &listenerConfig{spec: "inetd"}
+
+	if conn, err := net.FileConn(in); err == nil {
+		_, lc.port = splitAddr(conn.LocalAddr())
+		return conn, lc
+	}
+
+	lc.port = os.Getenv("TCPLOCALPORT")
+	if lc.port == "" {
+		lc.port = defaultListen
+	}
+	return &stdioConn{in, out, remoteAddrFromEnv()}, lc
+}
+
+// The client's address from the environment variables set by tcpserver
+// (TCPREMOTEIP and TCPREMOTEPORT) or, failing that, REMOTE_ADDR and
+// REMOTE_PORT. It is nil if neither is set.
+func remoteAddrFromEnv() net.Addr {
+	ipVar, portVar := "TCPREMOTEIP", "TCPREMOTEPORT"
+	if os.Getenv(ipVar) == "" {
+		ipVar, portVar = "REMOTE_ADDR", "REMOTE_PORT"
+	}
+	ip := net.ParseIP(os.Getenv(ipVar))
+	if ip == nil {
+		return nil
+	}
+	port, _ := strconv.Atoi(os.Getenv(portVar))
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+// A connection that reads from one file and writes to another, such as
+// standard input and standard output.
+type stdioConn struct {
+	in, out *os.File
+	remote  net.Addr
+}
+
+func (c *stdioConn) Read(b []byte) (int, error)  { return c.in.Read(b) }
+func (c *stdioConn) Write(b []byte) (int, error) { return c.out.Write(b) }
+func (c *stdioConn) LocalAddr() net.Addr         { return nil }
+func (c *stdioConn) RemoteAddr() net.Addr        { return c.remote }
+
+func (c *stdioConn) Close() error {
+	c.in.Close()
+	return c.out.Close()
+}
+
+// Deadlines work only if the files support them (pipes do, regular files
+// and terminals don't); otherwise they are ignored.
+func (c *stdioConn) SetDeadline(t time.Time) error {
+	c.in.SetDeadline(t)
+	return c.out.SetDeadline(t)
+}
+func (c *stdioConn) SetReadDeadline(t time.Time) error  { return c.in.SetReadDeadline(t) }
+func (c *stdioConn) SetWriteDeadline(t time.Time) error { return c.out.SetWriteDeadline(t) }
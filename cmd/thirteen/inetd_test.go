@@ -0,0 +1,95 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInetdConnFromSocket(t *testing.T) {
+	at := assert.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	server, err := l.Accept()
+	require.NoError(t, err)
+	f, err := server.(*net.TCPConn).File()
+	require.NoError(t, err)
+	server.Close()
+	defer f.Close()
+
+	conn, lc := inetdConn(f, f)
+	defer conn.Close()
+	c := newClient(conn, lc)
+	_, clientPort := splitAddr(client.LocalAddr())
+	_, serverPort := splitAddr(l.Addr())
+	at.Equal("127.0.0.1", c.addr)
+	at.Equal(clientPort, c.port)
+	at.Equal(serverPort, lc.port)
+}
+
+func TestInetdConnFromPipes(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		addr string
+		port string
+	}{
+		{"No address", nil, "", ""},
+		{"tcpserver", map[string]string{"TCPREMOTEIP": "192.0.2.1", "TCPREMOTEPORT": "5000", "REMOTE_ADDR": "192.0.2.2"}, "192.0.2.1", "5000"},
+		{"REMOTE_ADDR", map[string]string{"REMOTE_ADDR": "2001:db8::1", "REMOTE_PORT": "5001"}, "2001:db8::1", "5001"},
+		{"Bad address", map[string]string{"REMOTE_ADDR": "example.org"}, "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			at := assert.New(t)
+			for _, name := range []string{"TCPREMOTEIP", "TCPREMOTEPORT", "REMOTE_ADDR", "REMOTE_PORT", "TCPLOCALPORT"} {
+				t.Setenv(name, tc.env[name])
+			}
+
+			in, out, err := os.Pipe()
+			require.NoError(t, err)
+			defer in.Close()
+			defer out.Close()
+
+			conn, lc := inetdConn(in, out)
+			c := newClient(conn, lc)
+			at.Equal(tc.addr, c.addr)
+			at.Equal(tc.port, c.port)
+			at.Equal(defaultListen, lc.port)
+		})
+	}
+}
+
+func TestServeInetd(t *testing.T) {
+	at := assert.New(t)
+
+	root := useTestSite(t)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "hello.txt"), []byte("Hello, world!\n"), 0644))
+	t.Setenv("TCPLOCALPORT", "7070")
+
+	requestIn, requestOut, err := os.Pipe()
+	require.NoError(t, err)
+	responseIn, responseOut, err := os.Pipe()
+	require.NoError(t, err)
+	defer responseIn.Close()
+
+	_, err = requestOut.WriteString("/hello.txt\r\n")
+	require.NoError(t, err)
+	requestOut.Close()
+
+	serveInetd(requestIn, responseOut)
+	response, err := io.ReadAll(responseIn)
+	at.NoError(err)
+	at.Equal("Hello, world!\n", string(response))
+}
@@ -0,0 +1,76 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLandlockHandledAccess(t *testing.T) {
+	for _, tc := range []struct {
+		abi    int
+		access uint64
+	}{
+		{1, 0x1fff},
+		{2, 0x3fff},
+		{3, 0x7fff},
+		{4, 0x7fff},
+		{5, 0xffff},
+		{7, 0xffff},
+	} {
+		t.Run(fmt.Sprint(tc.abi), func(t *testing.T) {
+			assert.Equal(t, tc.access, landlockHandledAccess(tc.abi))
+		})
+	}
+}
+
+// Run in a child process by TestLandlock, since the sandbox can't be
+// removed once enforced.
+func TestLandlockChild(t *testing.T) {
+	dir := os.Getenv("THIRTEEN_TEST_LANDLOCK")
+	if dir == "" {
+		t.Skip("run by TestLandlock")
+	}
+	status, err := enforceLandlock([]string{filepath.Join(dir, "allowed")})
+	require.NoError(t, err)
+	fmt.Println("status:", status)
+	if !strings.Contains(status, "enforced") {
+		return
+	}
+	for _, name := range []string{"allowed/file", "denied/file"} {
+		_, err := os.ReadFile(filepath.Join(dir, name))
+		fmt.Printf("read %s: %v\n", name, err == nil)
+	}
+	err = os.WriteFile(filepath.Join(dir, "allowed/new"), nil, 0644)
+	fmt.Printf("write allowed/new: %v\n", err == nil)
+}
+
+func TestLandlock(t *testing.T) {
+	at := assert.New(t)
+
+	dir := t.TempDir()
+	for _, name := range []string{"allowed", "denied"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name, "file"), []byte("x"), 0644))
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLandlockChild$", "-test.v")
+	cmd.Env = append(os.Environ(), "THIRTEEN_TEST_LANDLOCK="+dir)
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	if !strings.Contains(string(out), "status: ") || !strings.Contains(string(out), "enforced") {
+		t.Skipf("Landlock not enforced: %s", out)
+	}
+	at.Contains(string(out), "read allowed/file: true")
+	at.Contains(string(out), "read denied/file: false")
+	at.Contains(string(out), "write allowed/new: false")
+}
@@ -0,0 +1,62 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import "sync"
+
+// A limiter limits how many holders a resource may have at once. The limit
+// may be changed at any time; lowering it doesn't affect current holders.
+type limiter struct {
+	mu     sync.Mutex
+	limit  int
+	active int
+
+	// closed (and replaced) whenever a slot may have become available
+	changed chan struct{}
+}
+
+func newLimiter(limit int) *limiter {
+	return &limiter{limit: limit, changed: make(chan struct{})}
+}
+
+// Wait for a slot and take it. Give up (and return false) if cancel is
+// closed first. A nil cancel waits forever.
+func (l *limiter) acquire(cancel <-chan struct{}) bool {
+	for {
+		l.mu.Lock()
+		if l.active < l.limit {
+			l.active++
+			l.mu.Unlock()
+			return true
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-cancel:
+			return false
+		}
+	}
+}
+
+// Give up a slot taken by acquire.
+func (l *limiter) release() {
+	l.mu.Lock()
+	l.active--
+	l.notify()
+	l.mu.Unlock()
+}
+
+func (l *limiter) setLimit(limit int) {
+	l.mu.Lock()
+	l.limit = limit
+	l.notify()
+	l.mu.Unlock()
+}
+
+// Wake up all waiters. l.mu must be held.
+func (l *limiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
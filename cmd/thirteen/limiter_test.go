@@ -0,0 +1,38 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	at := assert.New(t)
+	l := newLimiter(1)
+
+	at.True(l.acquire(nil))
+
+	// full: give up when canceled
+	cancel := make(chan struct{})
+	close(cancel)
+	at.False(l.acquire(cancel))
+
+	// full: wait for a release
+	acquired := make(chan bool)
+	go func() { acquired <- l.acquire(nil) }()
+	select {
+	case <-acquired:
+		t.Fatal("acquired a slot while full")
+	case <-time.After(10 * time.Millisecond):
+	}
+	l.release()
+	at.True(<-acquired)
+
+	// full: wait for the limit to be raised
+	go func() { acquired <- l.acquire(nil) }()
+	l.setLimit(2)
+	at.True(<-acquired)
+}
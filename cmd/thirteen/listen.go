@@ -0,0 +1,245 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const defaultListen = "70"
+
+// The configuration of a listener, from a -listen option of the form
+// `[host:]port[,name=value...]`, `unix:path[,name=value...]`, or
+// `systemd[:name][,name=value...]`.
+type listenerConfig struct {
+	spec       string // the -listen option as given
+	host, port string
+
+	// listen on a unix socket at unixPath instead of host and port,
+	// changing its mode and owner if not 0 or empty, respectively
+	unixPath  string
+	unixMode  os.FileMode
+	unixOwner string
+
+	// use sockets passed by systemd (only those named systemdName, if
+	// not empty) instead of listening on host and port
+	systemd     bool
+	systemdName string
+
+	// override -serverhost and -serverport for connections on this
+	// listener if not empty or 0, respectively
+	serverHost string
+	serverPort int
+
+	tls     bool // Gopher over TLS
+	autoTLS bool // also plain Gopher (tls=auto)
+
+	proxy bool // trusted proxies send a PROXY protocol header
+}
+
+// Parse a -listen option.
+func parseListenSpec(spec string) (*listenerConfig, error) {
+	addr, options, _ := strings.Cut(spec, ",")
+	l := &listenerConfig{spec: spec}
+
+	if addr == "systemd" || strings.HasPrefix(addr, "systemd:") {
+		l.systemd = true
+		_, l.systemdName, _ = strings.Cut(addr, ":")
+	} else if strings.HasPrefix(addr, "unix:") {
+		l.unixPath = strings.TrimPrefix(addr, "unix:")
+		if l.unixPath == "" {
+			return nil, fmt.Errorf("missing unix socket path")
+		}
+	} else {
+		var err error
+		l.host, l.port, err = splitListenAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		if port, err := strconv.Atoi(l.port); err != nil || port <= 0 || 65535 < port {
+			return nil, fmt.Errorf("port must be between 1 and 65535")
+		}
+	}
+
+	for options != "" {
+		var option string
+		option, options, _ = strings.Cut(options, ",")
+		name, value, _ := strings.Cut(option, "=")
+		switch name {
+		case "serverhost":
+			l.serverHost = value
+		case "serverport":
+			port, err := strconv.Atoi(value)
+			if err != nil || port <= 0 || 65535 < port {
+				return nil, fmt.Errorf("serverport must be between 1 and 65535")
+			}
+			l.serverPort = port
+		case "tls":
+			switch value {
+			case "":
+			case "auto":
+				l.autoTLS = true
+			default:
+				return nil, fmt.Errorf("tls must be tls or tls=auto")
+			}
+			l.tls = true
+		case "proxy":
+			if value != "" {
+				return nil, fmt.Errorf("proxy takes no value")
+			}
+			l.proxy = true
+		case "mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode == 0 || 0777 < mode {
+				return nil, fmt.Errorf("mode must be an octal file mode between 1 and 777")
+			}
+			l.unixMode = os.FileMode(mode)
+		case "owner":
+			if value == "" {
+				return nil, fmt.Errorf("owner must be user or user:group")
+			}
+			l.unixOwner = value
+		default:
+			return nil, fmt.Errorf("unknown listen option %q", name)
+		}
+	}
+	if l.unixPath == "" && (l.unixMode != 0 || l.unixOwner != "") {
+		return nil, fmt.Errorf("mode and owner apply only to unix listeners")
+	}
+	return l, nil
+}
+
+// Split a listen address of the form `[host:]port` into host and port. An
+// IPv6 host must be in brackets, as in `[::1]:70`. An empty host means all
+// IPv4 and IPv6 addresses.
+func splitListenAddr(listen string) (host, port string, err error) {
+	if !strings.Contains(listen, ":") {
+		return "", listen, nil
+	}
+	return net.SplitHostPort(listen)
+}
+
+// The host name to include in menus and give to CGIs.
+func (l *listenerConfig) getServerHost() string {
+	if l.serverHost != "" {
+		return l.serverHost
+	}
+	return configString("serverhost")
+}
+
+// The port to include in menus and give to CGIs.
+func (l *listenerConfig) getServerPort() string {
+	if l.serverPort != 0 {
+		return strconv.Itoa(l.serverPort)
+	}
+	if port := configInt("serverport"); port != 0 {
+		return strconv.Itoa(port)
+	}
+	if l.port == "" {
+		// a unix socket has no port
+		return defaultListen
+	}
+	return l.port
+}
+
+type listener struct {
+	net.Listener
+	config *listenerConfig
+}
+
+// Open a listener for each -listen option. On error, any listeners that
+// were opened are closed.
+func openListeners(configs []*listenerConfig) (listeners []*listener, err error) {
+	var sockets []activatedSocket
+	for _, lc := range configs {
+		if lc.systemd {
+			if sockets, err = activatedSockets(); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	used := make([]bool, len(sockets))
+	defer func() {
+		for i, s := range sockets {
+			if !used[i] {
+				s.Close()
+			}
+		}
+		if err != nil {
+			closeListeners(listeners)
+			listeners = nil
+		}
+	}()
+
+	for _, lc := range configs {
+		if lc.systemd {
+			found := false
+			for i, s := range sockets {
+				if used[i] || (lc.systemdName != "" && s.name != lc.systemdName) {
+					continue
+				}
+				used[i], found = true, true
+				// each socket has its own port for menus
+				sc := *lc
+				_, sc.port = splitAddr(s.Addr())
+				listeners = append(listeners, newListener(s.Listener, &sc))
+			}
+			if !found {
+				return listeners, fmt.Errorf("listen %s: no matching socket from systemd", lc.spec)
+			}
+			continue
+		}
+
+		var l net.Listener
+		if lc.unixPath != "" {
+			l, err = listenUnix(lc)
+		} else {
+			l, err = net.Listen("tcp", net.JoinHostPort(lc.host, lc.port))
+		}
+		if err != nil {
+			return listeners, err
+		}
+		listeners = append(listeners, newListener(l, lc))
+	}
+	return listeners, nil
+}
+
+// Make a listener. TLS is not set up here but by the client's handshake,
+// after any PROXY header has been read.
+func newListener(l net.Listener, lc *listenerConfig) *listener {
+	return &listener{l, lc}
+}
+
+func closeListeners(listeners []*listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// Accept connections on a listener until shutdown is closed.
+func (l *listener) serve(shutdown <-chan struct{}) {
+	for {
+		if !connLimit.acquire(shutdown) {
+			return
+		}
+		conn, err := l.Accept()
+		if err != nil {
+			connLimit.release()
+			select {
+			case <-shutdown:
+				return
+			default:
+			}
+			logf("accept on %s: %v", l.config.spec, err)
+			continue
+		}
+		openConns.Add(1)
+		openConnCount.Add(1)
+		go handleConn(conn, l.config)
+	}
+}
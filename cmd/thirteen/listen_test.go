@@ -0,0 +1,164 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseListenSpec(t *testing.T) {
+	for _, tc := range []struct {
+		spec       string
+		host       string
+		port       string
+		serverHost string
+		serverPort int
+		isError    bool
+	}{
+		{"70", "", "70", "", 0, false},
+		{"[::1]:7070", "::1", "7070", "", 0, false},
+		{"127.0.0.1:7070,serverhost=localhost", "127.0.0.1", "7070", "localhost", 0, false},
+		{"7070,serverhost=gopher.example.org,serverport=70", "", "7070", "gopher.example.org", 70, false},
+		{"0", "", "", "", 0, true},
+		{"65536", "", "", "", 0, true},
+		{"gopher", "", "", "", 0, true},
+		{"70,serverport=x", "", "", "", 0, true},
+		{"70,bogus=1", "", "", "", 0, true},
+		{"70,tls=yes", "", "", "", 0, true},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			at := assert.New(t)
+			l, err := parseListenSpec(tc.spec)
+			at.Equal(tc.isError, err != nil)
+			if err == nil {
+				at.Equal(tc.spec, l.spec)
+				at.Equal(tc.host, l.host)
+				at.Equal(tc.port, l.port)
+				at.Equal(tc.serverHost, l.serverHost)
+				at.Equal(tc.serverPort, l.serverPort)
+			}
+		})
+	}
+}
+
+func TestParseListenSpecTLS(t *testing.T) {
+	at := assert.New(t)
+
+	l, err := parseListenSpec("7443,tls")
+	at.NoError(err)
+	at.True(l.tls)
+	at.False(l.autoTLS)
+
+	l, err = parseListenSpec("70,tls=auto")
+	at.NoError(err)
+	at.True(l.tls)
+	at.True(l.autoTLS)
+}
+
+func TestListenerServerHostAndPort(t *testing.T) {
+	at := assert.New(t)
+
+	// the default configuration has -serverhost localhost and
+	// -serverport 0
+	l, err := parseListenSpec("7070")
+	at.NoError(err)
+	at.Equal("localhost", l.getServerHost())
+	at.Equal("7070", l.getServerPort())
+
+	l, err = parseListenSpec("7070,serverhost=gopher.example.org,serverport=70")
+	at.NoError(err)
+	at.Equal("gopher.example.org", l.getServerHost())
+	at.Equal("70", l.getServerPort())
+}
+
+func TestSplitListenAddr(t *testing.T) {
+	for _, tc := range []struct {
+		listen  string
+		host    string
+		port    string
+		isError bool
+	}{
+		{"70", "", "70", false},
+		{":70", "", "70", false},
+		{"127.0.0.1:70", "127.0.0.1", "70", false},
+		{"localhost:70", "localhost", "70", false},
+		{"[::1]:70", "::1", "70", false},
+		{"[::]:70", "::", "70", false},
+		{"[::1]", "", "", true},
+		{"::1:70", "", "", true},
+	} {
+		t.Run(tc.listen, func(t *testing.T) {
+			at := assert.New(t)
+			host, port, err := splitListenAddr(tc.listen)
+			at.Equal(tc.isError, err != nil)
+			if err == nil {
+				at.Equal(tc.host, host)
+				at.Equal(tc.port, port)
+			}
+		})
+	}
+}
+
+func TestServeShutdown(t *testing.T) {
+	at := assert.New(t)
+	useConnLimit(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	shutdown := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		(&listener{l, &listenerConfig{spec: "test", host: "localhost", port: "70"}}).serve(shutdown)
+		close(stopped)
+	}()
+
+	// a connection is accepted and handled
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	fmt.Fprint(conn, "/nonexistent\r\n")
+	response, err := io.ReadAll(conn)
+	conn.Close()
+	at.NoError(err)
+	at.Contains(string(response), "3File not found.")
+
+	// shutdown (with the listener closed) stops accepting
+	close(shutdown)
+	l.Close()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve didn't return")
+	}
+}
+
+func TestServeShutdownWhileFull(t *testing.T) {
+	oldLimit := connLimit
+	connLimit = newLimiter(0)
+	t.Cleanup(func() { connLimit = oldLimit })
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	shutdown := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		(&listener{l, &listenerConfig{spec: "test"}}).serve(shutdown)
+		close(stopped)
+	}()
+
+	// waiting for a connection slot is given up at shutdown
+	close(shutdown)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve didn't return")
+	}
+}
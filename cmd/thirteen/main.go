@@ -6,6 +6,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
@@ -14,11 +15,13 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -29,16 +32,8 @@ const (
 )
 
 var (
-	// must read a request within this time
-	requestReadTimeout time.Duration
-
-	// must write at least one byte to the client during this time
-	responseProgressTimeout time.Duration
-
 	docRoot string
 
-	excluded = make(map[string]bool, 10)
-
 	startTime = time.Now()
 )
 
@@ -47,14 +42,144 @@ type configOption struct {
 	value interface{}
 }
 
+// Options that take effect only at startup. Changes to these (and to
+// -listen and -landlockallow) are ignored when the configuration is
+// reloaded.
+var startupOptions = []string{"allowroot", "chroot", "inetd", "landlock", "root", "user"}
+
 var configMap = map[string]configOption{
+	"allowroot": configOption{
+		"Allow running as root. Without this, the server\n" +
+			"refuses to start if it would still be root after\n" +
+			"changing to -user.",
+		newBool(false),
+	},
+	"backendtmo": configOption{
+		"Backend timeout in `seconds`. How long to wait to\n" +
+			"connect to a FastCGI or SCGI backend, and for each\n" +
+			"read from it. Setting to 0 disables backend timeout.",
+		newInt(60),
+	},
+	"cgicache": configOption{
+		"How long in `seconds` to cache a CGI's output for\n" +
+			"the same selector, query, and search. A CGI may\n" +
+			"set its own time with a Cache-Control header (see\n" +
+			"-cgiheaders). Setting to 0 caches only the output\n" +
+			"of CGIs that set a time.",
+		newInt(0),
+	},
+	"cgicachesize": configOption{
+		"The most CGI output to cache in `megabytes`.\n" +
+			"Setting to 0 disables the cache.",
+		newInt(16),
+	},
+	"cgicpu": configOption{
+		"The CPU time limit for CGIs in `seconds`.\n" +
+			"Setting to 0 disables the limit.",
+		newInt(0),
+	},
+	"cgifiles": configOption{
+		"The maximum number of open `files` for CGIs.\n" +
+			"Setting to 0 disables the limit.",
+		newInt(0),
+	},
+	"cgifsize": configOption{
+		"The maximum size in `megabytes` of files written by\n" +
+			"CGIs. Setting to 0 disables the limit.",
+		newInt(0),
+	},
+	"cgiheaders": configOption{
+		"CGIs send headers (Status, X-Gopher-Type,\n" +
+			"Location, X-Sendfile, and Cache-Control) and a\n" +
+			"blank line before their output, unless their names\n" +
+			"start with nph-.",
+		newBool(false),
+	},
+	"cgimax": configOption{
+		"The maximum `number` of CGIs that may run at once.\n" +
+			"Setting to 0 disables the limit.",
+		newInt(0),
+	},
+	"cgimem": configOption{
+		"The address space (memory) limit for CGIs in\n" +
+			"`megabytes`. Setting to 0 disables the limit.",
+		newInt(0),
+	},
+	"cgioutput": configOption{
+		"The maximum number of `megabytes` a CGI may send\n" +
+			"to the client. Setting to 0 disables the limit.",
+		newInt(0),
+	},
+	"cgipath": configOption{
+		"The `PATH` given to CGIs. With -chroot, this is\n" +
+			"a path within the site root.",
+		newString(safePath),
+	},
+	"cgiprocs": configOption{
+		"The maximum number of `processes` for the user\n" +
+			"that CGIs run as. Setting to 0 disables the limit.",
+		newInt(0),
+	},
+	"cgiscriptmax": configOption{
+		"The maximum `number` of copies of each CGI that may\n" +
+			"run at once. Setting to 0 disables the limit.",
+		newInt(0),
+	},
+	"cgitmo": configOption{
+		"CGI timeout in `seconds`. How long a CGI may run\n" +
+			"before it is stopped. Setting to 0 disables CGI\n" +
+			"timeout.",
+		newInt(0),
+	},
+	"cgiwait": configOption{
+		"How long a request may wait in `seconds` for a CGI\n" +
+			"to be allowed to run (see -cgimax and\n" +
+			"-cgiscriptmax) before the server is reported busy.",
+		newInt(5),
+	},
+	"chroot": configOption{
+		"Change the root directory to the site root\n" +
+			"before changing to -user. CGIs then run in the\n" +
+			"site root and can use only the programs in it.",
+		newBool(false),
+	},
+	"dcgi": configOption{
+		"Run files with the given `extension` as dynamic CGIs,\n" +
+			"whose output is GPH (as in geomyidae) to be made\n" +
+			"into a menu.",
+		newString(""),
+	},
 	"desc": configOption{
 		"The server `description`.",
 		newString(""),
 	},
-	"listen": configOption{
-		"The `[host:]port` to listen on.",
-		newString("70"),
+	"drain": configOption{
+		"How long to wait in `seconds` for connections to\n" +
+			"finish when shutting down. CGIs that are still\n" +
+			"running after that are killed.",
+		newInt(30),
+	},
+	"errorlog": configOption{
+		"The error log `file` for CGIs' standard error.\n" +
+			"Standard error is used if not given.",
+		newString(""),
+	},
+	"errorlogmax": configOption{
+		"The maximum number of `kilobytes` of a CGI's\n" +
+			"standard error to log for each request. Setting\n" +
+			"to 0 disables the limit.",
+		newInt(64),
+	},
+	"inetd": configOption{
+		"Serve a single request from standard input to\n" +
+			"standard output and exit, as when run by inetd.",
+		newBool(false),
+	},
+	"landlock": configOption{
+		"Restrict the server and CGIs to reading files\n" +
+			"under the site root (and -landlockallow paths)\n" +
+			"with Landlock, if the kernel supports it.",
+		newBool(false),
 	},
 	"maxconn": configOption{
 		"The maximum number of simultaneous `connections`.",
@@ -75,9 +200,18 @@ var configMap = map[string]configOption{
 		newString("localhost"),
 	},
 	"serverport": configOption{
-		"The `port` to include in menus.",
+		"The `port` to include in menus. Setting to 0\n" +
+			"uses the port of the listener.",
 		newInt(0),
 	},
+	"tlscert": configOption{
+		"The TLS certificate `file` (PEM) for tls listeners.",
+		newString(""),
+	},
+	"tlskey": configOption{
+		"The TLS private key `file` (PEM) for tls listeners.",
+		newString(""),
+	},
 	"user": configOption{
 		"The `user` to run as.",
 		newString(""),
@@ -92,134 +226,226 @@ var configMap = map[string]configOption{
 
 func newString(v string) *string { p := new(string); *p = v; return p }
 func newInt(v int) *int          { p := new(int); *p = v; return p }
+func newBool(v bool) *bool       { p := new(bool); *p = v; return p }
 
-func configInt(name string) int {
-	if u, ok := configMap[name].value.(*int); ok {
-		return *u
-	}
-	return 0
-}
-func configString(name string) string {
-	switch u := configMap[name].value.(type) {
-	case *int:
-		return fmt.Sprintf("%d", *u)
-	case *string:
-		return *u
-	default:
-		return "unsupport type"
-	}
-}
-func setConfigInt(name string, value int) {
-	if u, ok := configMap[name].value.(*int); ok {
-		*u = value
-	}
-}
-func setConfigString(name string, value string) {
-	if u, ok := configMap[name].value.(*string); ok {
-		*u = value
-	}
-}
+func configInt(name string) int       { return getConfig().Int(name) }
+func configString(name string) string { return getConfig().String(name) }
+func configBool(name string) bool     { return getConfig().Bool(name) }
 
-var connChan chan struct{}
+// Limits the number of simultaneous connections.
+var connLimit *limiter
+
+// Connections that are still being handled, for draining at shutdown.
+var (
+	openConns     sync.WaitGroup
+	openConnCount atomic.Int64
+)
 
 func main() {
-	// get config from arguments
-	for name, option := range configMap {
-		switch u := option.value.(type) {
-		case *int:
-			flag.IntVar(u, string(name), *u, option.usage)
-		case *string:
-			flag.StringVar(u, string(name), *u, option.usage)
-		default:
-			panic("unsupported type")
-		}
-	}
-	flag.Func("exclude", "Exclude files with the given `extension`.", func(ext string) error {
-		if ext == "" {
-			// don't exclude blank
-			return nil
-		}
-		if !strings.HasPrefix(ext, ".") {
-			// extension is missing the leading dot? that's alright!
-			ext = "." + ext
-		}
-		if strings.Contains(ext[1:], ".") {
-			return fmt.Errorf("extension contains two or more dots")
-		}
-		excluded[ext] = true
-		return nil
-	})
-	flag.Parse()
-
-	maxConn := configInt("maxconn")
-	if maxConn < 1 {
-		fmt.Fprintln(os.Stderr, "Error: maxconn must be > 0.")
-		return
+	if os.Args[0] == limitHelperName {
+		runLimitHelper(os.Args[1:])
 	}
 
-	r := configInt("rtmo")
-	if r < 0 {
-		fmt.Fprintln(os.Stderr, "Error: rtmo must be >= 0.")
+	c, err := parseConfig(flag.CommandLine, os.Args[1:])
+	if err == nil {
+		err = c.check()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		return
 	}
-	requestReadTimeout = time.Duration(r) * time.Second
+	currentConfig.Store(c)
 
-	w := configInt("wtmo")
-	if w < 0 {
-		fmt.Fprintln(os.Stderr, "Error: wtmo must be >= 0.")
+	docRoot, err = filepath.Abs(configString("root"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		return
 	}
-	responseProgressTimeout = time.Duration(w) * time.Second
-
-	hostPortRe := regexp.MustCompilePOSIX(`^((.*):)?([^:]*)$`)
-
-	listen := configString("listen")
-	listenHost := hostPortRe.ReplaceAllString(listen, "$2")
-	listenPort := hostPortRe.ReplaceAllString(listen, "$3")
 
-	var err error
-	var port int
+	connLimit = newLimiter(configInt("maxconn"))
+	cgiLimit.setLimit(getConfig().cgiMax)
 
-	if port, err = strconv.Atoi(listenPort); err != nil || port <= 0 || 65535 < port {
-		fmt.Fprintln(os.Stderr, "Error: port must be between 1 and 65535.")
+	if err = loadCertificate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		return
 	}
 
-	docRoot, err = filepath.Abs(configString("root"))
-	if err != nil {
+	if err = openErrorLog(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		return
 	}
 
-	if serverport := configInt("serverport"); serverport == 0 {
-		setConfigInt("serverport", port)
+	var listeners []*listener
+	if !configBool("inetd") {
+		listeners, err = openListeners(c.listeners)
+		if err != nil {
+			fmt.Print("net.Listen: " + err.Error())
+			os.Exit(1)
+		}
+
+		if err = openNotifySocket(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
-	connChan = make(chan struct{}, maxConn)
+	// load the local time zone for log timestamps while /etc/localtime
+	// can still be read
+	time.Now().Zone()
 
-	listener, err := net.Listen("tcp", listenHost+":"+listenPort)
-	if err != nil {
-		fmt.Print("net.Listen: " + err.Error())
-		os.Exit(1)
+	// CGIs with resource limits are run through this program (which
+	// isn't in a -chroot root, but then there are no limits)
+	if !configBool("chroot") {
+		if exe, err := os.Executable(); err == nil {
+			limitHelperPath = exe
+		}
 	}
 
-	if user := configString("user"); user != "" {
-		err = changeUser(user)
+	if user, chroot := configString("user"), configBool("chroot"); user != "" || chroot {
+		chrootDir := ""
+		if chroot {
+			chrootDir = docRoot
+		}
+		err = changeUser(user, chrootDir)
 		if err != nil {
 			fmt.Print("changeUser: " + err.Error())
 			os.Exit(1)
 		}
+		if chroot {
+			docRoot = "/"
+		}
+	}
+	if os.Geteuid() == 0 && !configBool("allowroot") {
+		fmt.Fprintf(os.Stderr, "Error: refusing to run as root (use -user, or -allowroot to run as root anyway)\n")
+		os.Exit(1)
 	}
 
-	for {
-		connChan <- struct{}{}
-		conn, err := listener.Accept()
+	if configBool("landlock") {
+		paths := append([]string{docRoot}, c.landlockPaths...)
+		if limitHelperPath != "" {
+			paths = append(paths, limitHelperPath)
+		}
+		status, err := enforceLandlock(paths)
 		if err != nil {
-			fmt.Print("Accept: " + err.Error())
-			continue
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		logf("landlock: %s", status)
+	}
+
+	if configBool("inetd") {
+		serveInetd(os.Stdin, os.Stdout)
+		return
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadConfig()
+		}
+	}()
+
+	term := make(chan os.Signal, 2)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	shutdown := make(chan struct{})
+	go func() {
+		logf("%v: shutting down", <-term)
+		notify(fmt.Sprintf("STOPPING=1\nSTATUS=Waiting for %d connections to finish", openConnCount.Load()))
+		close(shutdown)
+		closeListeners(listeners)
+	}()
+
+	notify(fmt.Sprintf("READY=1\nSTATUS=Listening on %d sockets", len(listeners)))
+
+	var serving sync.WaitGroup
+	for _, l := range listeners {
+		serving.Add(1)
+		go func(l *listener) {
+			defer serving.Done()
+			l.serve(shutdown)
+		}(l)
+	}
+	serving.Wait()
+
+	drain(&openConns, term)
+}
+
+// Wait for open connections (conns) to finish, then kill any CGIs that
+// are still running and log a summary. Another signal on term stops
+// waiting early.
+func drain(conns *sync.WaitGroup, term <-chan os.Signal) {
+	waiting := openConnCount.Load()
+	done := make(chan struct{})
+	go func() {
+		conns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Duration(configInt("drain")) * time.Second):
+	case sig := <-term:
+		logf("%v: not waiting for connections to finish", sig)
+	}
+
+	remaining := openConnCount.Load()
+	stopped := killCGIs()
+	logf("shutdown: %d of %d connections finished, %d cut off, %d CGIs stopped; served %d requests (%d bytes) in %d seconds; %d CGI requests queued, %d rejected as busy",
+		waiting-remaining, waiting, remaining, stopped, requestCount.Load(), bytesTransferred.Load(), getUptime(), cgiQueued.Load(), cgiRejected.Load())
+}
+
+// Reload the configuration from the command line and the configuration
+// file and make it current. Startup options keep their current values. If
+// the new configuration is invalid, the current configuration is kept.
+func reloadConfig() {
+	notify("RELOADING=1")
+	defer notify("READY=1")
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	c, err := parseConfig(fs, os.Args[1:])
+	if err != nil {
+		logf("reload: %v; keeping current configuration", err)
+		return
+	}
+	old := getConfig()
+	if c.listenSpecs() != old.listenSpecs() {
+		logf("reload: ignoring change to -listen (restart required)")
+	}
+	c.listeners, c.listenOptions = old.listeners, old.listenOptions
+	if strings.Join(c.landlockPaths, "\x00") != strings.Join(old.landlockPaths, "\x00") {
+		logf("reload: ignoring change to -landlockallow (restart required)")
+		c.landlockPaths = old.landlockPaths
+	}
+	for _, name := range startupOptions {
+		if c.String(name) != old.String(name) {
+			logf("reload: ignoring change to -%s (restart required)", name)
+			c.values[name] = old.values[name]
 		}
-		go handleConn(conn)
 	}
+	if err = c.check(); err != nil {
+		logf("reload: %v; keeping current configuration", err)
+		return
+	}
+
+	currentConfig.Store(c)
+	connLimit.setLimit(c.Int("maxconn"))
+	cgiLimit.setLimit(c.cgiMax)
+	clearCGICache()
+	if err = loadCertificate(); err != nil {
+		logf("reload: %v; keeping current certificate", err)
+	}
+	if err = openErrorLog(); err != nil {
+		logf("reload: %v; keeping current error log", err)
+	}
+	logf("reload: configuration reloaded")
+}
+
+// Log a message that is not about a particular request.
+func logf(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "%s %s\n", time.Now().Format(time.RFC3339), fmt.Sprintf(format, a...))
 }
 
 type statusCode int
@@ -230,6 +456,7 @@ const (
 	forbiddenStatus           statusCode = 403
 	fileNotFoundStatus        statusCode = 404
 	internalServerErrorStatus statusCode = 500
+	serviceUnavailableStatus  statusCode = 503
 )
 
 type responseError struct {
@@ -242,6 +469,7 @@ var (
 	fileNotFoundError        = &responseError{fileNotFoundStatus, "File not found."}
 	forbiddenError           = &responseError{forbiddenStatus, "Forbidden."}
 	internalServerErrorError = &responseError{internalServerErrorStatus, "Internal server error."}
+	serviceUnavailableError  = &responseError{serviceUnavailableStatus, "Server busy. Please try again later."}
 )
 
 type response struct {
@@ -251,11 +479,15 @@ type response struct {
 }
 
 type requestInfo struct {
+	id          string
 	host        string
+	ident       string
 	requestTime time.Time
 	request     []byte
 	status      statusCode
 	transferred uint64
+	cgi         *cgiExit     // nil if not a CGI
+	cache       *cacheResult // nil if the CGI output cache wasn't used
 }
 
 var (
@@ -264,71 +496,203 @@ var (
 )
 
 func (r *requestInfo) log() {
+	fmt.Fprintln(os.Stderr, r)
+
+	requestCount.Add(1)
+	bytesTransferred.Add(r.transferred)
+}
+
+// A connection from a client.
+type client struct {
+	net.Conn
+	listener *listenerConfig
+	addr     string // the client's address, without the port
+	port     string // the client's port
+	id       string // the request ID, for the logs
+
+	redirects int          // internal redirects by CGIs' Location headers so far
+	cache     *cacheResult // for the last CGI looked up in the cache, if any
+
+	tls  *tls.ConnectionState // nil if not encrypted
+	peer *peerCredentials     // nil if not connected to a unix socket
+}
+
+func newClient(conn net.Conn, listener *listenerConfig) *client {
+	c := &client{Conn: conn, listener: listener, id: newRequestID()}
+	c.addr, c.port = splitAddr(conn.RemoteAddr())
+	c.peer = getPeerCredentials(conn)
+	return c
+}
+
+// Split a network address into host and port. An IPv4-mapped IPv6 address
+// is given in IPv4 form. A unix socket address is given as "unix:", since
+// a client's unix socket usually has no name.
+func splitAddr(addr net.Addr) (host, port string) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		host = a.IP.String()
+		if a.Zone != "" {
+			host += "%" + a.Zone
+		}
+		return host, strconv.Itoa(a.Port)
+	case *net.UnixAddr:
+		return unixClientAddr, ""
+	case nil:
+		return "", ""
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String(), ""
+	}
+	return host, port
+}
+
+func (r *requestInfo) String() string {
 	transferred := "-"
 	if r.transferred != 0 {
 		transferred = fmt.Sprintf("%d", r.transferred)
 	}
-	fmt.Fprintf(os.Stderr, "%s %s %s [%s] %q %d %s\n", r.host, "-", "-", r.requestTime.Format(time.RFC3339), r.request, r.status, transferred)
-
-	requestCount.Add(1)
-	bytesTransferred.Add(r.transferred)
+	host, ident := r.host, r.ident
+	if host == "" {
+		host = "-"
+	}
+	if ident == "" {
+		ident = "-"
+	}
+	s := fmt.Sprintf("%s %s %s [%s] %q %d %s", host, ident, "-", r.requestTime.Format(time.RFC3339), r.request, r.status, transferred)
+	// extra fields
+	if r.id != "" {
+		s += " id=" + r.id
+	}
+	if r.cache != nil {
+		s += " cache=" + r.cache.String()
+	}
+	if r.cgi != nil {
+		s += " " + r.cgi.String()
+	}
+	return s
 }
 
-func handleConn(conn net.Conn) {
-	defer func() { _ = <-connChan }()
-	defer conn.Close()
+func handleConn(conn net.Conn, listener *listenerConfig) {
+	defer openConns.Done()
+	defer openConnCount.Add(-1)
+	defer connLimit.release()
 
-	var remoteAddr string
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		remoteAddr = tcpConn.RemoteAddr().String()
-		remoteAddr, _, _ = strings.Cut(remoteAddr, ":")
+	client := newClient(conn, listener)
+	defer client.Close()
+	if err := client.readProxyHeader(); err != nil {
+		logf("PROXY header from %s: %v", client.addr, err)
+		return
+	}
+	if err := client.handshake(); err != nil {
+		logf("TLS handshake with %s: %v", client.addr, err)
+		return
 	}
 
 	var response response
 	var requestInfo requestInfo
 
-	request, err := readRequest(conn)
+	request, err := readRequest(client)
 	if err != nil {
-		response = makeErrorResponse(badRequestError)
+		response = makeErrorResponse(client, badRequestError)
 	} else {
 		selector, path, query, search := splitRequest(request)
 
-		response = getResponseForRequest(conn, selector, path, query, search)
-		if response.cmd != nil {
-			defer response.cmd.Wait()
-		}
+		response = getResponseForRequest(client, selector, path, query, search)
 	}
 
 	requestInfo.requestTime = time.Now()
 	requestInfo.request = request
-	requestInfo.host = remoteAddr
-
-	if closer, ok := response.Reader.(io.Closer); ok {
-		defer closer.Close()
+	requestInfo.id = client.id
+	requestInfo.host = client.addr
+	if client.peer != nil {
+		requestInfo.ident = client.peer.String()
 	}
 
 	requestInfo.status = response.status
+	if c := client.cache; c != nil && (c.hit || c.ttl != 0) {
+		// (a request whose output can't be cached isn't a miss)
+		requestInfo.cache = c
+	}
 
 	defer requestInfo.log()
 
-	for {
+	// a CGI is waited for after its output has been sent (or after it
+	// has exited without sending any), so how it exited can be logged
+	cmd := response.cmd
+	if cmd != nil {
+		defer watchClient(client, cmd)()
+	}
+	finishCGI := func() {
+		if cmd != nil && requestInfo.cgi == nil {
+			requestInfo.cgi = waitCGI(cmd)
+		}
+	}
+	defer finishCGI()
+
+	if closer, ok := response.Reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	for first := true; ; first = false {
 		buf := make([]byte, 1000)
 		n, err := response.Read(buf)
+		if n == 0 && first && cmd != nil {
+			// nothing has been sent yet, so the client can still be
+			// told if the CGI failed
+			finishCGI()
+			if !requestInfo.cgi.success() {
+				response = makeErrorResponse(client, internalServerErrorError)
+				requestInfo.status = response.status
+				n, err = response.Read(buf)
+			}
+		}
+		if n == 0 && first && err != nil && err != io.EOF {
+			// the response (from a backend, say) failed before
+			// anything was sent
+			response = makeErrorResponse(client, internalServerErrorError)
+			requestInfo.status = response.status
+			n, err = response.Read(buf)
+		}
 		if n == 0 {
 			// end of response
 			break
 		}
 
-		if responseProgressTimeout != 0 {
-			conn.SetWriteDeadline(time.Now().Add(responseProgressTimeout))
+		// a CGI may send only so much
+		overLimit := false
+		if limit := getConfig().cgiOutputLimit; response.cmd != nil && limit != 0 && requestInfo.transferred+uint64(n) > limit {
+			n = int(limit - requestInfo.transferred)
+			overLimit = true
+		}
+
+		if timeout := getConfig().responseProgressTimeout; timeout != 0 {
+			client.SetWriteDeadline(time.Now().Add(timeout))
 		}
-		n, err = conn.Write(buf[:n])
+		n, err = client.Write(buf[:n])
 		requestInfo.transferred += uint64(n)
+		if err != nil && response.cmd != nil {
+			// nobody is listening any more
+			stopCGI(response.cmd, fmt.Sprintf("could not write to client (%v)", err))
+		}
+		if overLimit && err == nil {
+			stopCGI(response.cmd, fmt.Sprintf("exceeded the output limit of %d bytes", getConfig().cgiOutputLimit))
+			break
+		}
 		// if an error happened or nothing transfers then we're done
 		if err != nil || n == 0 {
 			break
 		}
 	}
+
+	// all of the CGI's output has been sent, so it can be cached if the
+	// CGI succeeded
+	if c := requestInfo.cache; c != nil && c.done && cmd != nil {
+		finishCGI()
+		if requestInfo.cgi.success() {
+			storeCGICache(c)
+		}
+	}
 }
 
 // Read a request from the client.
@@ -343,8 +707,8 @@ func readRequest(conn net.Conn) ([]byte, error) {
 	requestBuf := make([]byte, 0, initialRequestSize)
 	buf := make([]byte, readChunkSize)
 	reader := bufio.NewReader(conn)
-	if requestReadTimeout != 0 {
-		conn.SetReadDeadline(time.Now().Add(requestReadTimeout))
+	if timeout := getConfig().requestReadTimeout; timeout != 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
 	}
 	for len(requestBuf) < maxRequestSize {
 		n, err := reader.Read(buf)
@@ -413,43 +777,58 @@ var indexPaths = []string{
 }
 
 // Open the file or whatever and return a response.
-func getResponseForRequest(conn net.Conn, selector, path, query, search string) response {
-	fsPath, scriptName, pathInfo, err := splitPath(docRoot, path)
+func getResponseForRequest(client *client, selector, path, query, search string) response {
+	path, err := cleanPath(path)
+	if err != nil {
+		return makeErrorResponse(client, err)
+	}
+
+	if b, scriptName, pathInfo := getConfig().findBackend(path); b != nil {
+		return runBackend(client, b, selector, scriptName, pathInfo, query, search)
+	}
+
+	fsPath, scriptName, pathInfo, err := splitScriptPathAndPathInfo(docRoot+path, len(docRoot))
 	if err != nil {
-		return makeErrorResponse(err)
+		return makeErrorResponse(client, err)
 	}
 
-	return getResponseFromPath(conn, selector, fsPath, scriptName, pathInfo, query, search)
+	return getResponseFromPath(client, selector, fsPath, scriptName, pathInfo, query, search)
 }
 
-func getResponseFromPath(conn net.Conn, selector, fsPath, scriptName, pathInfo, query, search string) response {
+func getResponseFromPath(client *client, selector, fsPath, scriptName, pathInfo, query, search string) response {
 	f, err := os.Open(fsPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return makeErrorResponse(fileNotFoundError)
+			return makeErrorResponse(client, fileNotFoundError)
 		} else {
-			return makeErrorResponse(forbiddenError)
+			return makeErrorResponse(client, forbiddenError)
 		}
 	}
 
-	if strings.HasSuffix(fsPath, cgiExt) {
+	if isCGIPath(fsPath) {
+		fileInfo, err := f.Stat()
 		f.Close()
 
-		// TODO check that it's executable
-		return runCGI(conn, selector, fsPath, scriptName, pathInfo, query, search)
+		// like any file, a CGI must be readable by all; it must also be
+		// executable by all unless it is run with an interpreter
+		if cgiInterpreter(fsPath) == nil && (err != nil || fileInfo.Mode()&0001 == 0) {
+			logf("CGI %s is not executable (it must be executable by all users)", fsPath)
+			return makeErrorResponse(client, forbiddenError)
+		}
+		return runCGI(client, selector, fsPath, scriptName, pathInfo, query, search)
 	}
 
 	// only CGIs can have extra path information
 	if pathInfo != "" {
 		f.Close()
 
-		return makeErrorResponse(fileNotFoundError)
+		return makeErrorResponse(client, fileNotFoundError)
 	}
 
 	return response{f, okStatus, nil}
 }
 
-func runCGI(conn net.Conn, selector, fsPath, scriptName, pathInfo, query, search string) response {
+func runCGI(client *client, selector, fsPath, scriptName, pathInfo, query, search string) response {
 	// pass info as command-line arguments as per geomyidae
 	cmd := exec.Command(fsPath,
 		// Query string (type 7) or "" (type 0).
@@ -459,10 +838,10 @@ func runCGI(conn net.Conn, selector, fsPath, scriptName, pathInfo, query, search
 		query,
 
 		// Server's hostname.
-		configString("serverhost"),
+		client.listener.getServerHost(),
 
 		// Server's port.
-		configString("serverport"),
+		client.listener.getServerPort(),
 
 		// Remaining path from path traversal in REST case.
 		pathInfo,
@@ -471,6 +850,41 @@ func runCGI(conn net.Conn, selector, fsPath, scriptName, pathInfo, query, search
 		selector,
 	)
 
+	if cached, ok := lookupCGICache(client, cgiCacheKey(client, selector, query, search)); ok {
+		return cached
+	}
+
+	release, busyErr := acquireCGI(fsPath)
+	if busyErr != nil {
+		return makeErrorResponse(client, busyErr)
+	}
+	started := false
+	defer func() {
+		if !started {
+			release()
+		}
+	}()
+
+	// run the interpreter (if any) with the script as its first argument
+	if interpreter := cgiInterpreter(fsPath); interpreter != nil {
+		path, err := findInterpreter(interpreter[0])
+		if err != nil {
+			logf("CGI %s: %v", fsPath, err)
+			return makeErrorResponse(client, internalServerErrorError)
+		}
+		cmd.Path = path
+		cmd.Args = append(append([]string{}, interpreter...), cmd.Args...)
+	}
+
+	// resource limits are set before the CGI starts by the limit helper
+	if limits := getConfig().cgiLimits; len(limits) != 0 {
+		if limitHelperPath == "" {
+			logf("CGI %s: can't set resource limits: this program's executable is unknown", fsPath)
+			return makeErrorResponse(client, internalServerErrorError)
+		}
+		useLimitHelper(cmd, limits)
+	}
+
 	if lastSlash := strings.LastIndex(fsPath, "/"); lastSlash != -1 {
 		cmd.Dir = fsPath[:lastSlash]
 	} else {
@@ -478,30 +892,62 @@ func runCGI(conn net.Conn, selector, fsPath, scriptName, pathInfo, query, search
 		cmd.Dir = docRoot
 	}
 
-	remoteAddr := ""
-	remotePort := ""
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		remoteAddr, remotePort, _ = strings.Cut(tcpConn.RemoteAddr().String(), ":")
+	cmd.Env = cgiEnv(client, selector, fsPath, scriptName, pathInfo, query, search)
+
+	setProcessGroup(cmd)
+
+	reader, err := cmd.StdoutPipe()
+	if err != nil {
+		// XXX or other error?
+		return makeErrorResponse(client, internalServerErrorError)
+	}
+
+	// standard error goes to the error log (through a pipe of our own,
+	// so waiting for the CGI doesn't wait for standard error to close)
+	stderr, stderrWriter, err := os.Pipe()
+	if err != nil {
+		reader.Close()
+		return makeErrorResponse(client, internalServerErrorError)
 	}
+	cmd.Stderr = stderrWriter
+
+	err = cmd.Start()
+	stderrWriter.Close()
+	if err != nil {
+		stderr.Close()
+		// XXX or other error?
+		return makeErrorResponse(client, internalServerErrorError)
+	}
+	go logCGIStderr(stderr, client, fsPath)
+
+	startedCGI(cmd, fsPath, release)
+	started = true
+
+	return cgiResponse(client, fsPath, cmd, reader)
+}
+
+// Make the environment for a CGI.
+func cgiEnv(client *client, selector, fsPath, scriptName, pathInfo, query, search string) []string {
 	pathTranslated := ""
 	if pathInfo != "" {
 		pathTranslated = docRoot + pathInfo
 	}
-	cmd.Env = []string{
-		"PATH=" + safePath,
+	serverHost, serverPort := client.listener.getServerHost(), client.listener.getServerPort()
+	env := []string{
+		"PATH=" + configString("cgipath"),
 		"GATEWAY_INTERFACE=CGI/1.1",                  // CGI
 		"SERVER_PROTOCOL=GOPHER",                     // CGI
 		"SERVER_SOFTWARE=" + serverSoftware,          // CGI
 		"REQUEST_METHOD=GET",                         // CGI
 		"PATH_INFO=" + pathInfo,                      // CGI
 		"PATH_TRANSLATED=" + pathTranslated,          // CGI
-		"SERVER_NAME=" + configString("serverhost"),  // CGI
-		"SERVER_HOST=" + configString("serverhost"),  // Bucktooth
-		"SERVER_PORT=" + configString("serverport"),  // CGI
+		"SERVER_NAME=" + serverHost,                  // CGI
+		"SERVER_HOST=" + serverHost,                  // Bucktooth
+		"SERVER_PORT=" + serverPort,                  // CGI
 		"QUERY_STRING=" + query,                      // CGI
-		"REMOTE_ADDR=" + remoteAddr,                  // CGI
-		"REMOTE_HOST=" + remoteAddr,                  // CGI
-		"REMOTE_PORT=" + remotePort,                  // PyGopherd, Bucktooth
+		"REMOTE_ADDR=" + client.addr,                 // CGI
+		"REMOTE_HOST=" + client.addr,                 // CGI
+		"REMOTE_PORT=" + client.port,                 // PyGopherd, Bucktooth
 		"SCRIPT_NAME=" + scriptName,                  // CGI
 		"SCRIPT_FILENAME=" + fsPath,                  // Apache, Gophernicus
 		"GOPHER_SCRIPT_FILENAME=" + fsPath,           // port70
@@ -515,39 +961,29 @@ func runCGI(conn net.Conn, selector, fsPath, scriptName, pathInfo, query, search
 		"SELECTOR=" + selector,                       // Gophernicus, PyGopherd, geomyidae, Bucktooth
 		"GOPHER_DOCUMENT_SELECTOR=" + selector,       // port70
 		"REQUEST=" + scriptName + pathInfo,           // Gophernicus, PyGopherd, geomyidae, Bucktooth
+		"REQUEST_ID=" + client.id,
 		fmt.Sprintf("THIRTEEN_UPTIME=%d", getUptime()),
 		fmt.Sprintf("THIRTEEN_REQUESTS=%d", requestCount.Load()),
 		fmt.Sprintf("THIRTEEN_BYTES=%d", bytesTransferred.Load()),
+		fmt.Sprintf("THIRTEEN_CGI_QUEUED=%d", cgiQueued.Load()),
+		fmt.Sprintf("THIRTEEN_CGI_REJECTED=%d", cgiRejected.Load()),
 
 		// (XXX Bucktooth doesn't support PATH_INFO so it's not clear
 		// whether REQUEST should include PATH_INFO or not)
 
 		// TODO add other environment variables
 	}
-
-	reader, err := cmd.StdoutPipe()
-	if err != nil {
-		// XXX or other error?
-		return makeErrorResponse(internalServerErrorError)
-	}
-	// TODO capture cmd's stderr and write it to an error log?
-
-	err = cmd.Start()
-	if err != nil {
-		// XXX or other error?
-		return makeErrorResponse(internalServerErrorError)
-	}
-
-	return response{reader, okStatus, cmd}
+	env = append(env, peerEnv(client)...)
+	return append(env, tlsEnv(client)...)
 }
 
 func getUptime() uint64 {
 	return uint64(time.Since(startTime).Round(time.Second).Seconds())
 }
 
-func makeErrorResponse(e *responseError) response {
+func makeErrorResponse(client *client, e *responseError) response {
 	return response{
-		strings.NewReader(makeDirEntry('3', e.message, configString("serverhost"), configString("serverport"))),
+		strings.NewReader(makeDirEntry('3', e.message, client.listener.getServerHost(), client.listener.getServerPort())),
 		e.status,
 		nil,
 	}
@@ -555,26 +991,38 @@ func makeErrorResponse(e *responseError) response {
 
 // make a Gopher directory entry
 func makeDirEntry(gtype byte, user string, host string, port string) string {
-	return fmt.Sprintf("%c%s\t\t%s\t%s\r\n.\r\n", gtype, user, host, port)
+	return makeMenuLine(gtype, user, "", host, port) + ".\r\n"
+}
+
+// make a line of a Gopher menu
+func makeMenuLine(gtype byte, user, selector, host, port string) string {
+	return fmt.Sprintf("%c%s\t%s\t%s\t%s\r\n", gtype, user, selector, host, port)
 }
 
 // get the file system path to the file, the script name, and the path info
 // corresponding to the given path
 func splitPath(rootPath, path string) (fsPath, scriptName, pathInfo string, err *responseError) {
+	path, err = cleanPath(path)
+	if err != nil {
+		return
+	}
+
+	return splitScriptPathAndPathInfo(rootPath+path, len(rootPath))
+}
+
+// URL unescape and normalize the path from a selector.
+func cleanPath(path string) (string, *responseError) {
 	// URL unescape path (so we can support a filename like "hello?")
 	path, e := url.PathUnescape(path)
 	if e != nil || strings.Contains(path, "\x00") {
-		err = badRequestError
-		return
+		return "", badRequestError
 	}
 
 	path, ok := normalizePath(path)
 	if !ok {
-		err = forbiddenError
-		return
+		return "", forbiddenError
 	}
-
-	return splitScriptPathAndPathInfo(rootPath+path, len(rootPath))
+	return path, nil
 }
 
 func splitScriptPathAndPathInfo(path string, startLength int) (fsPath, scriptName, pathInfo string, err *responseError) {
@@ -591,7 +1039,7 @@ func splitScriptPathAndPathInfo(path string, startLength int) (fsPath, scriptNam
 	err = fileNotFoundError
 
 	// if CGIs are excluded, we cannot proceed any further (the user asked for it!)
-	if excluded[cgiExt] {
+	if c := getConfig(); c.excluded[cgiExt] && c.dcgiExt == "" && len(c.interpreters) == 0 {
 		return
 	}
 
@@ -657,16 +1105,15 @@ func getStats(path string) (isFile, isDir, isCGI bool, responseErr *responseErro
 	mode := fileInfo.Mode()
 	needPerm := fs.FileMode(004)
 	if mode.IsRegular() {
-		if excluded[filepath.Ext(path)] {
+		if getConfig().excluded[filepath.Ext(path)] {
 			// this is not the path you're looking for
 			responseErr = forbiddenError
 			return
 		}
 		isFile = true
-		if strings.HasSuffix(path, cgiExt) {
-			isCGI = true
-			needPerm = 005
-		}
+		// (whether a CGI is executable is checked when it is run, so
+		// that it can be logged)
+		isCGI = isCGIPath(path)
 	} else if mode.IsDir() {
 		isDir = true
 		needPerm = 005
@@ -3,11 +3,117 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// Where the server logs (its standard error) during tests, for captureLog.
+// Standard error is replaced only once, before any test runs, since a
+// goroutine (such as a CGI's timer) may log at any time.
+var testLog *os.File
+
+func TestMain(m *testing.M) {
+	// the test binary stands in for this program as the limit helper
+	if os.Args[0] == limitHelperName {
+		runLimitHelper(os.Args[1:])
+	}
+
+	f, err := os.CreateTemp("", "thirteen-test-log")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	stderr := os.Stderr
+	testLog, os.Stderr, errorLog.w = f, f, f
+	code := m.Run()
+	if code != 0 {
+		// show what was logged, to help explain the failure
+		f.Seek(0, io.SeekStart)
+		io.Copy(stderr, f)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	os.Exit(code)
+}
+
+// Make the configuration from args current for the rest of the test.
+func useConfig(t *testing.T, args ...string) {
+	c, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), args)
+	require.NoError(t, err)
+	require.NoError(t, c.check())
+	old := getConfig()
+	currentConfig.Store(c)
+	t.Cleanup(func() { currentConfig.Store(old) })
+}
+
+// Use a connection limit of its own for the test, as handleConn needs.
+func useConnLimit(t *testing.T) {
+	old := connLimit
+	connLimit = newLimiter(1)
+	t.Cleanup(func() { connLimit = old })
+}
+
+// Use an empty site root (and a connection limit) for the test, and
+// return the site root.
+func useTestSite(t *testing.T) string {
+	useConnLimit(t)
+	old := docRoot
+	docRoot = t.TempDir()
+	t.Cleanup(func() { docRoot = old })
+	return docRoot
+}
+
+// Handle a connection with handleConn, as a listener would, and return
+// the client's end of it. done is closed once handleConn returns.
+func testConn() (client net.Conn, done <-chan struct{}) {
+	server, client := net.Pipe()
+	connLimit.acquire(nil)
+	openConns.Add(1)
+	openConnCount.Add(1)
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		handleConn(server, &listenerConfig{host: "localhost", port: "70"})
+	}()
+	return client, handled
+}
+
+// Send a request to handleConn and return the response.
+func testRequest(t *testing.T, selector string) string {
+	client, _ := testConn()
+	_, err := client.Write([]byte(selector + "\r\n"))
+	require.NoError(t, err)
+	response, err := io.ReadAll(client)
+	require.NoError(t, err)
+	return string(response)
+}
+
+// Capture what f logs (to standard error).
+func captureLog(t *testing.T, f func()) string {
+	size := func() int64 {
+		fi, err := testLog.Stat()
+		require.NoError(t, err)
+		return fi.Size()
+	}
+	start := size()
+	f()
+	log := make([]byte, size()-start)
+	_, err := testLog.ReadAt(log, start)
+	require.NoError(t, err)
+	return string(log)
+}
+
 func TestSplitRequest(t *testing.T) {
 	for _, tc := range []struct {
 		name     string
@@ -171,3 +277,159 @@ func TestSplitPath(t *testing.T) {
 		})
 	}
 }
+
+// A connection with a made-up remote address.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestClientAddr(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		remote net.Addr
+		addr   string
+		port   string
+	}{
+		{
+			"IPv4",
+			&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000},
+			"192.0.2.1", "5000",
+		},
+		{
+			"IPv6",
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000},
+			"2001:db8::1", "5000",
+		},
+		{
+			"IPv6 with zone",
+			&net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 5000, Zone: "eth0"},
+			"fe80::1%eth0", "5000",
+		},
+		{
+			"IPv4-mapped IPv6",
+			&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 5000},
+			"192.0.2.1", "5000",
+		},
+		{
+			"Unix socket",
+			&net.UnixAddr{Name: "@", Net: "unix"},
+			"unix:", "",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			at := assert.New(t)
+			c := newClient(addrConn{remote: tc.remote}, &listenerConfig{port: "70"})
+			at.Equal(tc.addr, c.addr)
+			at.Equal(tc.port, c.port)
+
+			r := requestInfo{host: c.addr, requestTime: time.Unix(0, 0).UTC(), request: []byte("/"), status: okStatus}
+			at.Equal(tc.addr+` - - [1970-01-01T00:00:00Z] "/" 200 -`, r.String())
+
+			env := cgiEnv(c, "/", "/srv/gopher/index.cgi", "", "/", "", "")
+			at.Contains(env, "REMOTE_ADDR="+tc.addr)
+			at.Contains(env, "REMOTE_HOST="+tc.addr)
+			at.Contains(env, "REMOTE_PORT="+tc.port)
+		})
+	}
+}
+
+func TestClientAddrFromListener(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		listen string
+		dial   string
+		addr   string
+	}{
+		{"IPv4", "127.0.0.1:0", "127.0.0.1", "127.0.0.1"},
+		{"IPv6", "[::1]:0", "::1", "::1"},
+		{"Dual-stack IPv4", ":0", "127.0.0.1", "127.0.0.1"},
+		{"Dual-stack IPv6", ":0", "::1", "::1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			at := assert.New(t)
+			host, port, err := splitListenAddr(tc.listen)
+			at.NoError(err)
+			listeners, err := openListeners([]*listenerConfig{{spec: tc.listen, host: host, port: port}})
+			if err != nil {
+				t.Skipf("cannot listen on %s: %v", tc.listen, err)
+			}
+			l := listeners[0]
+			defer l.Close()
+
+			_, port, _ = net.SplitHostPort(l.Addr().String())
+			d, err := net.Dial("tcp", net.JoinHostPort(tc.dial, port))
+			if err != nil {
+				t.Skipf("cannot dial %s: %v", tc.dial, err)
+			}
+			defer d.Close()
+
+			conn, err := l.Accept()
+			at.NoError(err)
+			defer conn.Close()
+
+			c := newClient(conn, l.config)
+			_, localPort, _ := net.SplitHostPort(d.LocalAddr().String())
+			at.Equal(tc.addr, c.addr)
+			at.Equal(localPort, c.port)
+			at.False(strings.ContainsAny(c.addr, "[]"))
+		})
+	}
+}
+
+func TestCGIPath(t *testing.T) {
+	at := assert.New(t)
+	c := newClient(addrConn{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000}}, &listenerConfig{port: "70"})
+
+	env := cgiEnv(c, "/", "/srv/gopher/index.cgi", "", "/", "", "")
+	at.Contains(env, "PATH="+safePath)
+
+	useConfig(t, "-cgipath", "/bin")
+	env = cgiEnv(c, "/", "/srv/gopher/index.cgi", "", "/", "", "")
+	at.Contains(env, "PATH=/bin")
+}
+
+func TestDrain(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		finish  bool // the open connection finishes
+		signal  bool // another signal is sent
+		maxTime time.Duration
+		log     string
+	}{
+		{"Connection finishes", nil, true, false, 5 * time.Second, "shutdown: 1 of 1 connections finished, 0 cut off"},
+		{"Drain time", []string{"-drain", "1"}, false, false, 5 * time.Second, "shutdown: 0 of 1 connections finished, 1 cut off"},
+		{"Second signal", nil, false, true, time.Second, "terminated: not waiting for connections to finish"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			at := assert.New(t)
+			useConfig(t, tc.args...)
+			// a WaitGroup of its own, since drain may leave it being
+			// waited for
+			var conns sync.WaitGroup
+			conns.Add(1)
+			openConnCount.Add(1)
+			finish := func() {
+				openConnCount.Add(-1)
+				conns.Done()
+			}
+			if tc.finish {
+				time.AfterFunc(100*time.Millisecond, finish)
+			} else {
+				defer finish()
+			}
+			term := make(chan os.Signal, 1)
+			if tc.signal {
+				term <- syscall.SIGTERM
+			}
+
+			start := time.Now()
+			log := captureLog(t, func() { drain(&conns, term) })
+			at.Less(time.Since(start), tc.maxTime)
+			at.Contains(log, tc.log)
+		})
+	}
+}
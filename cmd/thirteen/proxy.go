@@ -0,0 +1,180 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parse a -proxytrust option: a CIDR block or a single IP address.
+func parseTrustedProxy(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		return ipNet, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Whether a connection from addr may send a PROXY header.
+func (c *config) isTrustedProxy(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range c.trustedProxies {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Read the PROXY protocol header if the client connected to a proxy
+// listener from a trusted proxy, and take the client's address from it.
+// A trusted proxy must send a header; a connection from anywhere else is
+// taken as a direct connection from a client.
+func (c *client) readProxyHeader() error {
+	if !c.listener.proxy || !getConfig().isTrustedProxy(c.RemoteAddr()) {
+		return nil
+	}
+
+	if timeout := getConfig().requestReadTimeout; timeout != 0 {
+		c.SetReadDeadline(time.Now().Add(timeout))
+		defer c.SetReadDeadline(time.Time{})
+	}
+	conn := &peekConn{c.Conn, bufio.NewReader(c.Conn)}
+	c.Conn = conn
+	addr, err := readProxyHeader(conn.r)
+	if err != nil {
+		return err
+	}
+	if addr != nil {
+		c.addr, c.port = splitAddr(addr)
+	}
+	return nil
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Read a PROXY protocol (version 1 or 2) header. Return the source
+// address, or nil if the header doesn't give one (as for a health check
+// from the proxy itself).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// Look at only as much as needed to tell which version it is, so a
+	// short request without a header doesn't wait for more bytes.
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case proxyV2Signature[0]:
+		start, err := r.Peek(len(proxyV2Signature))
+		if err == nil && bytes.Equal(start, proxyV2Signature) {
+			return readProxyHeaderV2(r)
+		}
+	case 'P':
+		return readProxyHeaderV1(r)
+	}
+	return nil, fmt.Errorf("missing PROXY header")
+}
+
+// Read a version 1 (text) header, such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 5000 70\r\n".
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	const maxLength = 107
+
+	line := make([]byte, 0, maxLength)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == maxLength {
+			return nil, fmt.Errorf("PROXY header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" {
+		return nil, fmt.Errorf("missing PROXY header")
+	}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("bad PROXY header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || (fields[1] == "TCP4" && ip.To4() == nil) || err != nil || port < 0 || 65535 < port {
+		return nil, fmt.Errorf("bad PROXY header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// Read a version 2 (binary) header.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	const (
+		commandLocal = 0x0
+		commandProxy = 0x1
+
+		familyTCP4 = 0x11
+		familyTCP6 = 0x21
+	)
+
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	command, family := header[12]&0xf, header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case commandLocal:
+		return nil, nil
+	case commandProxy:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY command %d", command)
+	}
+
+	// Only the source address and port are needed. Any other
+	// information (destination, TLVs) is ignored.
+	switch family {
+	case familyTCP4:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("PROXY header too short")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case familyTCP6:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("PROXY header too short")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	default:
+		// UDP, unix sockets, or unspecified: the source isn't a TCP
+		// client, so keep the proxy's address
+		return nil, nil
+	}
+}
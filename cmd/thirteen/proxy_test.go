@@ -0,0 +1,248 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(command, family byte, body string) string {
+		return "\r\n\r\n\x00\r\nQUIT\n" + string([]byte{0x20 | command, family, 0, byte(len(body))}) + body
+	}
+
+	for _, tc := range []struct {
+		name    string
+		header  string
+		addr    string
+		isError bool
+	}{
+		{
+			"v1 TCP4",
+			"PROXY TCP4 192.0.2.1 198.51.100.1 5000 70\r\n",
+			"192.0.2.1:5000", false,
+		},
+		{
+			"v1 TCP6",
+			"PROXY TCP6 2001:db8::1 2001:db8::2 5000 70\r\n",
+			"[2001:db8::1]:5000", false,
+		},
+		{
+			"v1 TCP6 IPv4-mapped",
+			"PROXY TCP6 ::ffff:192.0.2.1 ::ffff:198.51.100.1 5000 70\r\n",
+			"192.0.2.1:5000", false,
+		},
+		{
+			"v1 UNKNOWN",
+			"PROXY UNKNOWN\r\n",
+			"", false,
+		},
+		{
+			"v1 UNKNOWN with addresses",
+			"PROXY UNKNOWN 192.0.2.1 198.51.100.1 5000 70\r\n",
+			"", false,
+		},
+		{
+			"v1 wrong family",
+			"PROXY TCP4 2001:db8::1 2001:db8::2 5000 70\r\n",
+			"", true,
+		},
+		{
+			"v1 missing fields",
+			"PROXY TCP4 192.0.2.1 198.51.100.1 5000\r\n",
+			"", true,
+		},
+		{
+			"v1 bad port",
+			"PROXY TCP4 192.0.2.1 198.51.100.1 70000 70\r\n",
+			"", true,
+		},
+		{
+			"v1 too long",
+			"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n",
+			"", true,
+		},
+		{
+			"v2 TCP4",
+			v2(1, 0x11, "\xc0\x00\x02\x01\xc6\x33\x64\x01\x13\x88\x00\x46"),
+			"192.0.2.1:5000", false,
+		},
+		{
+			"v2 TCP4 with TLVs",
+			v2(1, 0x11, "\xc0\x00\x02\x01\xc6\x33\x64\x01\x13\x88\x00\x46\x04\x00\x01\x00"),
+			"192.0.2.1:5000", false,
+		},
+		{
+			"v2 TCP6",
+			v2(1, 0x21, "\x20\x01\x0d\xb8"+strings.Repeat("\x00", 11)+"\x01"+
+				"\x20\x01\x0d\xb8"+strings.Repeat("\x00", 11)+"\x02"+"\x13\x88\x00\x46"),
+			"[2001:db8::1]:5000", false,
+		},
+		{
+			"v2 LOCAL",
+			v2(0, 0x00, ""),
+			"", false,
+		},
+		{
+			"v2 unix socket",
+			v2(1, 0x31, strings.Repeat("\x00", 216)),
+			"", false,
+		},
+		{
+			"v2 short addresses",
+			v2(1, 0x11, "\xc0\x00\x02\x01"),
+			"", true,
+		},
+		{
+			"v2 bad version",
+			"\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x00",
+			"", true,
+		},
+		{
+			"Missing",
+			"/\r\n",
+			"", true,
+		},
+		{
+			"Gopher request",
+			"/some/selector\r\n",
+			"", true,
+		},
+		{
+			"Gopher request starting with P",
+			"PROXY\r\n",
+			"", true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			at := assert.New(t)
+			r := bufio.NewReader(strings.NewReader(tc.header + "/foo\r\n"))
+			addr, err := readProxyHeader(r)
+			at.Equal(tc.isError, err != nil, "%v", err)
+			if err != nil {
+				return
+			}
+			if tc.addr == "" {
+				at.Nil(addr)
+			} else if at.NotNil(addr) {
+				at.Equal(tc.addr, addr.String())
+			}
+
+			// the request follows the header
+			rest, _ := io.ReadAll(r)
+			at.Equal("/foo\r\n", string(rest))
+		})
+	}
+}
+
+func TestClientProxyHeader(t *testing.T) {
+	useConfig(t, "-proxytrust", "10.0.0.0/8", "-proxytrust", "2001:db8::1")
+
+	for _, tc := range []struct {
+		name     string
+		listener string
+		remote   string
+		send     string
+		addr     string
+		port     string
+		request  string
+	}{
+		{
+			"Trusted IPv4 proxy",
+			"70,proxy",
+			"10.1.2.3",
+			"PROXY TCP6 2001:db8::5 2001:db8::6 5000 70\r\n/foo\r\n",
+			"2001:db8::5", "5000", "/foo",
+		},
+		{
+			"Trusted IPv6 proxy",
+			"70,proxy",
+			"2001:db8::1",
+			"PROXY TCP4 192.0.2.1 198.51.100.1 5000 70\r\n/foo\r\n",
+			"192.0.2.1", "5000", "/foo",
+		},
+		{
+			"Trusted proxy health check",
+			"70,proxy",
+			"10.1.2.3",
+			"PROXY UNKNOWN\r\n/foo\r\n",
+			"10.1.2.3", "4000", "/foo",
+		},
+		{
+			"Untrusted client",
+			"70,proxy",
+			"192.0.2.99",
+			"PROXY TCP4 192.0.2.1 198.51.100.1 5000 70\r\n",
+			"192.0.2.99", "4000", "PROXY TCP4 192.0.2.1 198.51.100.1 5000 70",
+		},
+		{
+			"Not a proxy listener",
+			"70",
+			"10.1.2.3",
+			"PROXY TCP4 192.0.2.1 198.51.100.1 5000 70\r\n",
+			"10.1.2.3", "4000", "PROXY TCP4 192.0.2.1 198.51.100.1 5000 70",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			at := assert.New(t)
+			lc, err := parseListenSpec(tc.listener)
+			at.NoError(err)
+
+			server, conn := net.Pipe()
+			defer conn.Close()
+			go io.WriteString(conn, tc.send)
+
+			c := newClient(addrConn{server, &net.TCPAddr{IP: net.ParseIP(tc.remote), Port: 4000}}, lc)
+			defer c.Close()
+			at.NoError(c.readProxyHeader())
+			at.Equal(tc.addr, c.addr)
+			at.Equal(tc.port, c.port)
+
+			request, err := readRequest(c)
+			at.NoError(err)
+			at.Equal(tc.request, string(request))
+
+			env := cgiEnv(c, "/", "/srv/gopher/index.cgi", "", "/", "", "")
+			at.Contains(env, "REMOTE_ADDR="+tc.addr)
+		})
+	}
+}
+
+func TestTrustedProxyRequiresHeader(t *testing.T) {
+	useConfig(t, "-proxytrust", "10.0.0.0/8")
+	lc, err := parseListenSpec("70,proxy")
+	assert.NoError(t, err)
+
+	server, conn := net.Pipe()
+	defer conn.Close()
+	go io.WriteString(conn, "/foo\r\n")
+
+	c := newClient(addrConn{server, &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 4000}}, lc)
+	defer c.Close()
+	assert.Error(t, c.readProxyHeader())
+}
+
+func TestProxyListenerRequiresTrustedProxies(t *testing.T) {
+	for _, tc := range []struct {
+		args    []string
+		isError bool
+	}{
+		{[]string{"-listen", "70,proxy"}, true},
+		{[]string{"-listen", "70,proxy", "-proxytrust", "127.0.0.1"}, false},
+		{[]string{"-proxytrust", "bogus"}, true},
+		{[]string{"-proxytrust", "10.0.0.0/33"}, true},
+	} {
+		c, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), tc.args)
+		if err == nil {
+			err = c.check()
+		}
+		assert.Equal(t, tc.isError, err != nil, "%v: %v", tc.args, err)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Encode a request for an SCGI server: the environment (`NAME=value`
+// strings) as a netstring of headers, with CONTENT_LENGTH first, and no
+// body.
+func encodeSCGIRequest(env []string) []byte {
+	headers := []byte("CONTENT_LENGTH\x000\x00SCGI\x001\x00")
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		headers = append(headers, name...)
+		headers = append(headers, 0)
+		headers = append(headers, value...)
+		headers = append(headers, 0)
+	}
+	request := strconv.AppendInt(nil, int64(len(headers)), 10)
+	request = append(request, ':')
+	request = append(request, headers...)
+	return append(request, ',')
+}
+
+// Run a request with an SCGI server and return a response that streams
+// its response.
+func runSCGI(client *client, b *backendConfig, selector, scriptName, pathInfo, query, search string) response {
+	release, busyErr := acquireCGI(b.spec)
+	if busyErr != nil {
+		return makeErrorResponse(client, busyErr)
+	}
+
+	conn, err := dialBackend(b)
+	if err == nil {
+		_, err = conn.Write(encodeSCGIRequest(backendEnv(client, selector, scriptName, pathInfo, query, search)))
+		if err != nil {
+			conn.Close()
+		}
+	}
+	if err != nil {
+		logf("%v: %v", b, err)
+		release()
+		return makeErrorResponse(client, internalServerErrorError)
+	}
+
+	return response{&scgiReader{backend: b, conn: conn, release: release}, okStatus, nil}
+}
+
+// Reads an SCGI server's response, up to the end of the connection.
+type scgiReader struct {
+	backend *backendConfig
+	conn    net.Conn
+
+	closeOnce sync.Once
+	release   func()
+}
+
+func (s *scgiReader) Read(p []byte) (int, error) {
+	n, err := s.conn.Read(p)
+	if err != nil && err != io.EOF {
+		logf("%v: %v", s.backend, err)
+	}
+	return n, err
+}
+
+func (s *scgiReader) Close() error {
+	s.closeOnce.Do(s.release)
+	return s.conn.Close()
+}
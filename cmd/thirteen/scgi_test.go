@@ -0,0 +1,109 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeSCGIRequest(t *testing.T) {
+	at := assert.New(t)
+	request := encodeSCGIRequest([]string{"SELECTOR=/app", "EMPTY=", "EQUALS=a=b"})
+	at.Equal("56:CONTENT_LENGTH\x000\x00SCGI\x001\x00SELECTOR\x00/app\x00EMPTY\x00\x00EQUALS\x00a=b\x00,", string(request))
+
+	// a backend's request has no header more than once
+	server, conn := net.Pipe()
+	defer conn.Close()
+	c := newClient(server, &listenerConfig{host: "localhost", port: "70"})
+	defer c.Close()
+	request = encodeSCGIRequest(backendEnv(c, "/app/menu?q", "/app", "/menu", "q", ""))
+	_, err := readSCGIRequest(bufio.NewReader(bytes.NewReader(request)))
+	at.NoError(err)
+}
+
+// Read an SCGI request's headers, which (as the SCGI specification
+// requires) must not repeat.
+func readSCGIRequest(r *bufio.Reader) (map[string]string, error) {
+	length, err := r.ReadString(':')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(length, ":"))
+	if err != nil {
+		return nil, err
+	}
+	netstring := make([]byte, n+1)
+	if _, err = io.ReadFull(r, netstring); err != nil {
+		return nil, err
+	}
+	if netstring[n] != ',' {
+		return nil, fmt.Errorf("netstring doesn't end with a comma")
+	}
+	fields := bytes.Split(netstring[:n], []byte{0})
+	if len(fields) < 2 || string(fields[0]) != "CONTENT_LENGTH" {
+		return nil, fmt.Errorf("CONTENT_LENGTH isn't first")
+	}
+	headers := make(map[string]string)
+	for i := 0; i+1 < len(fields); i += 2 {
+		name := string(fields[i])
+		if _, ok := headers[name]; ok {
+			return nil, fmt.Errorf("duplicate header %s", name)
+		}
+		headers[name] = string(fields[i+1])
+	}
+	return headers, nil
+}
+
+func TestSCGI(t *testing.T) {
+	at := assert.New(t)
+
+	useConnLimit(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				h, err := readSCGIRequest(bufio.NewReader(conn))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if h["PATH_INFO"] == "/slow" {
+					time.Sleep(5 * time.Second)
+				}
+				fmt.Fprintf(conn, "iSCRIPT_NAME=%s PATH_INFO=%s QUERY_STRING=%s SCGI=%s METHOD=%s\r\n.\r\n",
+					h["SCRIPT_NAME"], h["PATH_INFO"], h["QUERY_STRING"], h["SCGI"], h["REQUEST_METHOD"])
+			}()
+		}
+	}()
+
+	useConfig(t, "-scgi", "/app="+l.Addr().String(), "-backendtmo", "1")
+	at.Equal("iSCRIPT_NAME=/app PATH_INFO=/menu QUERY_STRING=q SCGI=1 METHOD=GET\r\n.\r\n", testRequest(t, "/app/menu?q"))
+
+	// no response within -backendtmo
+	start := time.Now()
+	at.Equal("3Internal server error.\t\tlocalhost\t70\r\n.\r\n", testRequest(t, "/app/slow"))
+	at.Less(time.Since(start), 3*time.Second)
+
+	// nothing is listening
+	l.Close()
+	at.Equal("3Internal server error.\t\tlocalhost\t70\r\n.\r\n", testRequest(t, "/app"))
+}
@@ -0,0 +1,82 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The resource for each CGI resource limit option.
+var processLimitResources = map[string]int{
+	"cgicpu":   syscall.RLIMIT_CPU,
+	"cgifiles": syscall.RLIMIT_NOFILE,
+	"cgifsize": syscall.RLIMIT_FSIZE,
+	"cgimem":   syscall.RLIMIT_AS,
+	"cgiprocs": rlimitNPROC(),
+}
+
+// RLIMIT_NPROC, which package syscall doesn't define.
+func rlimitNPROC() int {
+	if strings.HasPrefix(runtime.GOARCH, "mips") {
+		return 8
+	}
+	return 6
+}
+
+// Run as the limit helper with the arguments given by useLimitHelper: set
+// the resource limits (both soft and hard), then execute the command. On
+// failure, the error goes to standard error (the error log) and the exit
+// status is 127, as for a shell that can't run a command.
+func runLimitHelper(args []string) {
+	err := fmt.Errorf("usage: %s resource=value[,...] path arg0 [arg...]", limitHelperName)
+	if len(args) >= 3 {
+		err = setLimits(args[0])
+	}
+	if err == nil {
+		err = syscall.Exec(args[1], args[2:], os.Environ())
+	}
+	fmt.Fprintf(os.Stderr, "%s: %v\n", limitHelperName, err)
+	os.Exit(127)
+}
+
+// Set this process's resource limits from a list like "0=10,7=64".
+func setLimits(specs string) error {
+	for _, spec := range strings.Split(specs, ",") {
+		resource, value, _ := strings.Cut(spec, "=")
+		r, err := strconv.Atoi(resource)
+		if err != nil {
+			return fmt.Errorf("invalid limit %q", spec)
+		}
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid limit %q", spec)
+		}
+		if err = syscall.Setrlimit(r, &syscall.Rlimit{Cur: v, Max: v}); err != nil {
+			return fmt.Errorf("limit %q: %v", spec, err)
+		}
+	}
+	return nil
+}
+
+// Get the credentials of the client connected to a unix socket with
+// SO_PEERCRED.
+func unixPeerCredentials(conn *net.UnixConn) *peerCredentials {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var cred *syscall.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return nil
+	}
+	return &peerCredentials{int(cred.Uid), int(cred.Gid), int(cred.Pid)}
+}
@@ -0,0 +1,34 @@
+//go:build unix && !linux
+
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// CGI resource limits are supported only on Linux.
+var processLimitResources = map[string]int{}
+
+// Without resource limits, there is no limit helper to run.
+func runLimitHelper(args []string) {
+	fmt.Fprintf(os.Stderr, "%s: not supported\n", limitHelperName)
+	os.Exit(127)
+}
+
+func setLimits(specs string) error {
+	return fmt.Errorf("not supported")
+}
+
+// Peer credentials are supported only on Linux.
+func unixPeerCredentials(conn *net.UnixConn) *peerCredentials {
+	return nil
+}
+
+// Landlock is supported only on Linux.
+func enforceLandlock(paths []string) (status string, err error) {
+	return "unsupported on this system", nil
+}
@@ -4,30 +4,79 @@
 package main
 
 import (
+	"os"
+	"os/exec"
 	"os/user"
 	"strconv"
 	"syscall"
 )
 
 const (
-	safePath        = "/usr/bin:/bin"
+	safePath        = "/usr/bin:/bin" // the default -cgipath
 	defaultSiteRoot = "/srv/gopher"
 )
 
-func changeUser(username string) error {
+// Change to the given user's user ID, group ID, and supplementary groups.
+// If chrootDir is not empty, also change the root directory to it first
+// (after looking up the user, which can't be done in the new root). Either
+// may be empty.
+func changeUser(username, chrootDir string) error {
+	var uid, gid int
+	var groups []int
 	if username != "" {
 		u, err := user.Lookup(username)
 		if err != nil {
 			return err
 		}
-		uid, err := strconv.Atoi(u.Uid)
-		if err != nil {
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
 			return err
 		}
-		err = syscall.Setuid(uid)
+		groupIds, err := u.GroupIds()
 		if err != nil {
 			return err
 		}
+		for _, g := range groupIds {
+			id, err := strconv.Atoi(g)
+			if err != nil {
+				return err
+			}
+			groups = append(groups, id)
+		}
+	}
+
+	if chrootDir != "" {
+		if err := syscall.Chroot(chrootDir); err != nil {
+			return err
+		}
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+	}
+
+	if username == "" {
+		return nil
+	}
+	// the groups must be changed while still root
+	if err := syscall.Setgroups(groups); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
 	}
-	return nil
+	return syscall.Setuid(uid)
+}
+
+// Run cmd in its own process group so it and any processes it starts can
+// be signaled together.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Send a signal to the process group of a command started with
+// setProcessGroup.
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	return syscall.Kill(-cmd.Process.Pid, sig)
 }
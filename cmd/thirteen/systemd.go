@@ -0,0 +1,94 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The first file descriptor passed by socket activation.
+const listenFDsStart = 3
+
+// A listening socket passed by systemd socket activation.
+type activatedSocket struct {
+	name string // from FileDescriptorName= in the socket unit
+	net.Listener
+}
+
+// Whether systemd passed listening sockets to this process.
+func socketActivated() bool {
+	return os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) && os.Getenv("LISTEN_FDS") != ""
+}
+
+// Take the listening sockets passed by systemd socket activation, if any.
+func activatedSockets() ([]activatedSocket, error) {
+	if !socketActivated() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("bad LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+	return socketsFromFDs(listenFDsStart, n, names)
+}
+
+// Make listeners from n consecutive file descriptors starting at first. The
+// file descriptors are closed (the listeners use duplicates).
+func socketsFromFDs(first, n int, names []string) ([]activatedSocket, error) {
+	sockets := make([]activatedSocket, 0, n)
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(first+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, s := range sockets {
+				s.Close()
+			}
+			return nil, fmt.Errorf("socket activation: fd %d: %v", first+i, err)
+		}
+		sockets = append(sockets, activatedSocket{name, l})
+	}
+	return sockets, nil
+}
+
+// The connection to the service manager's notification socket, or nil.
+var notifyConn net.Conn
+
+// Connect to the service manager's notification socket named by
+// NOTIFY_SOCKET, if any. The connection is made up front so notifications
+// can still be sent after changing user or root directory.
+func openNotifySocket() error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		return fmt.Errorf("NOTIFY_SOCKET: %v", err)
+	}
+	notifyConn = conn
+	return nil
+}
+
+// Tell the service manager about a change of state, such as "READY=1" or
+// "STATUS=...". Several assignments may be separated by newlines.
+func notify(state string) {
+	if notifyConn == nil {
+		return
+	}
+	if _, err := notifyConn.Write([]byte(state)); err != nil {
+		logf("notify: %v", err)
+	}
+}
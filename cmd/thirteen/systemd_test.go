@@ -0,0 +1,113 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotify(t *testing.T) {
+	at := assert.New(t)
+
+	// stand-in for systemd
+	path := filepath.Join(t.TempDir(), "notify")
+	systemd, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	defer systemd.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	require.NoError(t, openNotifySocket())
+	defer func() {
+		notifyConn.Close()
+		notifyConn = nil
+	}()
+
+	buf := make([]byte, 1000)
+	for _, state := range []string{
+		"READY=1\nSTATUS=Listening on 1 sockets",
+		"RELOADING=1",
+		"STOPPING=1",
+	} {
+		notify(state)
+		n, err := systemd.Read(buf)
+		at.NoError(err)
+		at.Equal(state, string(buf[:n]))
+	}
+}
+
+func TestNotifyWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	assert.NoError(t, openNotifySocket())
+	assert.Nil(t, notifyConn)
+	notify("READY=1")
+}
+
+func TestSocketsFromFDs(t *testing.T) {
+	at := assert.New(t)
+
+	// stand-ins for the sockets systemd would pass
+	var fds []int
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		f, err := l.(*net.TCPListener).File()
+		require.NoError(t, err)
+		fd, err := syscall.Dup(int(f.Fd()))
+		require.NoError(t, err)
+		f.Close()
+		l.Close()
+		fds = append(fds, fd)
+	}
+	if fds[1] != fds[0]+1 {
+		t.Skip("file descriptors are not consecutive")
+	}
+
+	sockets, err := socketsFromFDs(fds[0], 2, []string{"gopher"})
+	require.NoError(t, err)
+	require.Len(t, sockets, 2)
+	defer sockets[0].Close()
+	defer sockets[1].Close()
+	at.Equal("gopher", sockets[0].name)
+	at.Equal("", sockets[1].name)
+
+	// the sockets still listen
+	conn, err := net.Dial("tcp", sockets[1].Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestSocketActivated(t *testing.T) {
+	at := assert.New(t)
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	at.True(socketActivated())
+
+	// sockets passed to some other process
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	at.False(socketActivated())
+}
+
+func TestParseListenSpecSystemd(t *testing.T) {
+	at := assert.New(t)
+
+	l, err := parseListenSpec("systemd")
+	at.NoError(err)
+	at.True(l.systemd)
+	at.Equal("", l.systemdName)
+
+	l, err = parseListenSpec("systemd:gophers,tls,serverport=7443")
+	at.NoError(err)
+	at.True(l.systemd)
+	at.Equal("gophers", l.systemdName)
+	at.True(l.tls)
+	at.Equal(7443, l.serverPort)
+}
@@ -0,0 +1,114 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// The certificate for TLS listeners, from -tlscert and -tlskey.
+var certificate atomic.Pointer[tls.Certificate]
+
+// Load the certificate named by -tlscert and -tlskey. The current
+// certificate is kept on error.
+func loadCertificate() error {
+	certFile, keyFile := configString("tlscert"), configString("tlskey")
+	if certFile == "" && keyFile == "" {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	certificate.Store(&cert)
+	return nil
+}
+
+var tlsConfig = &tls.Config{
+	MinVersion: tls.VersionTLS12,
+	GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert := certificate.Load()
+		if cert == nil {
+			return nil, fmt.Errorf("no certificate")
+		}
+		return cert, nil
+	},
+}
+
+// The first byte of a TLS handshake record, which starts every TLS
+// connection. (A Gopher request never starts with this byte.)
+const tlsHandshakeRecordType = 0x16
+
+// Perform the TLS handshake if the client connected to a TLS listener
+// (after any PROXY header has been read). On a tls=auto listener, the
+// handshake is performed only if the client starts one; otherwise the
+// client is using plain Gopher.
+func (c *client) handshake() error {
+	if !c.listener.tls {
+		return nil
+	}
+	if timeout := getConfig().requestReadTimeout; timeout != 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+		defer c.SetDeadline(time.Time{})
+	}
+	if !c.listener.autoTLS {
+		c.Conn = tls.Server(c.Conn, tlsConfig)
+	} else {
+		conn := &peekConn{c.Conn, bufio.NewReader(c.Conn)}
+		c.Conn = conn
+		// (if this fails, so will reading the request)
+		first, err := conn.r.Peek(1)
+		if err == nil && first[0] == tlsHandshakeRecordType {
+			c.Conn = tls.Server(conn, tlsConfig)
+		}
+	}
+
+	tlsConn, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	state := tlsConn.ConnectionState()
+	c.tls = &state
+	return nil
+}
+
+// A connection that has peeked at what the client sent.
+type peekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// Make the TLS environment variables for a CGI. There are none if the
+// connection is not encrypted.
+func tlsEnv(c *client) []string {
+	if c.tls == nil {
+		return nil
+	}
+	version, ok := tlsVersionNames[c.tls.Version]
+	if !ok {
+		version = fmt.Sprintf("0x%04x", c.tls.Version)
+	}
+	return []string{
+		"HTTPS=on",
+		"TLS_VERSION=" + version,
+		"TLS_CIPHER=" + tls.CipherSuiteName(c.tls.CipherSuite),
+		"TLS_SNI=" + c.tls.ServerName,
+	}
+}
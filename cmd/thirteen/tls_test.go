@@ -0,0 +1,259 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Write a self-signed certificate and its key to certFile and keyFile.
+func writeTestCertificate(t *testing.T, certFile, keyFile, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
+
+func TestTLSListener(t *testing.T) {
+	at := assert.New(t)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, "first.example.org")
+	useConfig(t, "-tlscert", certFile, "-tlskey", keyFile)
+	require.NoError(t, loadCertificate())
+	t.Cleanup(func() { certificate.Store(nil) })
+
+	lc := &listenerConfig{spec: "test", host: "127.0.0.1", port: "0", tls: true}
+	listeners, err := openListeners([]*listenerConfig{lc})
+	require.NoError(t, err)
+	l := listeners[0]
+	defer l.Close()
+
+	// Connect and return the server's view of the client and the
+	// certificate the server presented.
+	connect := func() (*client, *x509.Certificate) {
+		done := make(chan *client)
+		go func() {
+			conn, err := l.Accept()
+			if !at.NoError(err) {
+				done <- nil
+				return
+			}
+			c := newClient(conn, lc)
+			at.NoError(c.handshake())
+			done <- c
+		}()
+
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			ServerName:         "gopher.example.org",
+			InsecureSkipVerify: true,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		c := <-done
+		require.NotNil(t, c)
+		t.Cleanup(func() { c.Close() })
+		return c, conn.ConnectionState().PeerCertificates[0]
+	}
+
+	c, cert := connect()
+	at.Equal("first.example.org", cert.Subject.CommonName)
+	env := cgiEnv(c, "/", "/srv/gopher/index.cgi", "", "/", "", "")
+	at.Contains(env, "HTTPS=on")
+	at.Contains(env, "TLS_VERSION=TLSv1.3")
+	at.Contains(env, "TLS_CIPHER="+tls.CipherSuiteName(c.tls.CipherSuite))
+	at.Contains(env, "TLS_SNI=gopher.example.org")
+
+	// reload the certificate
+	writeTestCertificate(t, certFile, keyFile, "second.example.org")
+	require.NoError(t, loadCertificate())
+	_, cert = connect()
+	at.Equal("second.example.org", cert.Subject.CommonName)
+
+	// keep the current certificate if the new one can't be loaded
+	require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0600))
+	at.Error(loadCertificate())
+	_, cert = connect()
+	at.Equal("second.example.org", cert.Subject.CommonName)
+}
+
+func TestAutoTLSListener(t *testing.T) {
+	at := assert.New(t)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, "gopher.example.org")
+	useConfig(t, "-tlscert", certFile, "-tlskey", keyFile)
+	require.NoError(t, loadCertificate())
+	t.Cleanup(func() { certificate.Store(nil) })
+
+	lc, err := parseListenSpec("7070,tls=auto,serverport=7070")
+	require.NoError(t, err)
+	lc.host, lc.port = "127.0.0.1", "0"
+	listeners, err := openListeners([]*listenerConfig{lc})
+	require.NoError(t, err)
+	l := listeners[0]
+	defer l.Close()
+
+	for _, tc := range []struct {
+		name string
+		dial func() (net.Conn, error)
+		tls  bool
+	}{
+		{
+			"Plain",
+			func() (net.Conn, error) { return net.Dial("tcp", l.Addr().String()) },
+			false,
+		},
+		{
+			"TLS",
+			func() (net.Conn, error) {
+				return tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+			},
+			true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			at := assert.New(t)
+
+			done := make(chan *client)
+			go func() {
+				conn, err := l.Accept()
+				if !at.NoError(err) {
+					done <- nil
+					return
+				}
+				c := newClient(conn, lc)
+				at.NoError(c.handshake())
+				done <- c
+			}()
+
+			conn, err := tc.dial()
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = conn.Write([]byte("/foo\r\n"))
+			at.NoError(err)
+
+			c := <-done
+			require.NotNil(t, c)
+			defer c.Close()
+			request, err := readRequest(c)
+			at.NoError(err)
+			at.Equal("/foo", string(request))
+
+			at.Equal(tc.tls, c.tls != nil)
+			env := cgiEnv(c, "/", "/srv/gopher/index.cgi", "", "/", "", "")
+			at.Contains(env, "SERVER_PORT=7070")
+			if tc.tls {
+				at.Contains(env, "HTTPS=on")
+			} else {
+				at.NotContains(env, "HTTPS=on")
+			}
+		})
+	}
+	at.True(lc.tls)
+}
+
+func TestTLSProxyListener(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, "gopher.example.org")
+	useConfig(t, "-tlscert", certFile, "-tlskey", keyFile, "-proxytrust", "127.0.0.1")
+	require.NoError(t, loadCertificate())
+	t.Cleanup(func() { certificate.Store(nil) })
+
+	for _, spec := range []string{"7070,tls,proxy", "7070,tls=auto,proxy"} {
+		t.Run(spec, func(t *testing.T) {
+			at := assert.New(t)
+			lc, err := parseListenSpec(spec)
+			require.NoError(t, err)
+			lc.host, lc.port = "127.0.0.1", "0"
+			listeners, err := openListeners([]*listenerConfig{lc})
+			require.NoError(t, err)
+			l := listeners[0]
+			defer l.Close()
+
+			done := make(chan *client)
+			go func() {
+				conn, err := l.Accept()
+				if !at.NoError(err) {
+					done <- nil
+					return
+				}
+				c := newClient(conn, lc)
+				at.NoError(c.readProxyHeader())
+				at.NoError(c.handshake())
+				done <- c
+			}()
+
+			// the proxy sends its header in plain text before the
+			// client's TLS handshake
+			raw, err := net.Dial("tcp", l.Addr().String())
+			require.NoError(t, err)
+			_, err = raw.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 5000 70\r\n"))
+			require.NoError(t, err)
+			conn := tls.Client(raw, &tls.Config{ServerName: "gopher.example.org", InsecureSkipVerify: true})
+			defer conn.Close()
+			_, err = conn.Write([]byte("/foo\r\n"))
+			at.NoError(err)
+
+			c := <-done
+			require.NotNil(t, c)
+			defer c.Close()
+			request, err := readRequest(c)
+			at.NoError(err)
+			at.Equal("/foo", string(request))
+
+			at.Equal("192.0.2.1", c.addr)
+			require.NotNil(t, c.tls)
+			env := cgiEnv(c, "/", "/srv/gopher/index.cgi", "", "/", "", "")
+			at.Contains(env, "REMOTE_ADDR=192.0.2.1")
+			at.Contains(env, "HTTPS=on")
+			at.Contains(env, "TLS_SNI=gopher.example.org")
+		})
+	}
+}
+
+func TestTLSListenerRequiresCertificate(t *testing.T) {
+	c, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-listen", "7070,tls"})
+	assert.NoError(t, err)
+	assert.Error(t, c.check())
+}
+
+func TestNoTLSEnvForPlainConnections(t *testing.T) {
+	env := cgiEnv(&client{listener: &listenerConfig{port: "70"}}, "/", "/srv/gopher/index.cgi", "", "/", "", "")
+	for _, v := range env {
+		assert.NotRegexp(t, "^(HTTPS|TLS_)", v)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// The address given for a client connected to a unix socket, in place of
+// an IP address.
+const unixClientAddr = "unix:"
+
+// Listen on the unix socket for a listener. A socket file left behind by
+// a server that is no longer running is removed first, but one that is
+// still accepting connections is left alone.
+func listenUnix(lc *listenerConfig) (net.Listener, error) {
+	if fi, err := os.Lstat(lc.unixPath); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", lc.unixPath); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("listen %s: socket is in use", lc.spec)
+		}
+		os.Remove(lc.unixPath)
+	}
+
+	l, err := net.Listen("unix", lc.unixPath)
+	if err != nil {
+		return nil, err
+	}
+	if lc.unixMode != 0 {
+		if err = os.Chmod(lc.unixPath, lc.unixMode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	if lc.unixOwner != "" {
+		uid, gid, err := lookupOwner(lc.unixOwner)
+		if err == nil {
+			err = os.Lchown(lc.unixPath, uid, gid)
+		}
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Look up an owner of the form `user[:group]`. The group is -1 (unchanged)
+// if not given.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	username, groupname, hasGroup := strings.Cut(owner, ":")
+	u, err := user.Lookup(username)
+	if err != nil {
+		return
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return
+	}
+	gid = -1
+	if hasGroup {
+		var g *user.Group
+		if g, err = user.LookupGroup(groupname); err != nil {
+			return
+		}
+		gid, err = strconv.Atoi(g.Gid)
+	}
+	return
+}
+
+// The credentials of the process at the other end of a unix socket.
+type peerCredentials struct {
+	uid, gid, pid int
+}
+
+// Get the credentials of the client connected to a unix socket. They are
+// nil for other connections or if the system doesn't provide them.
+func getPeerCredentials(conn net.Conn) *peerCredentials {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	return unixPeerCredentials(unixConn)
+}
+
+// For the ident field of the log.
+func (p *peerCredentials) String() string {
+	return fmt.Sprintf("uid=%d,pid=%d", p.uid, p.pid)
+}
+
+// Make the peer credential environment variables for a CGI. There are
+// none if the client didn't connect to a unix socket.
+func peerEnv(c *client) []string {
+	if c.peer == nil {
+		return nil
+	}
+	return []string{
+		"REMOTE_UID=" + strconv.Itoa(c.peer.uid),
+		"REMOTE_GID=" + strconv.Itoa(c.peer.gid),
+		"REMOTE_PID=" + strconv.Itoa(c.peer.pid),
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2025 Christopher Williams
+// SPDX-License-Identifier: GPL-2.0-only
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseListenSpecUnix(t *testing.T) {
+	for _, tc := range []struct {
+		spec    string
+		path    string
+		mode    os.FileMode
+		owner   string
+		isError bool
+	}{
+		{"unix:/run/thirteen.sock", "/run/thirteen.sock", 0, "", false},
+		{"unix:thirteen.sock,mode=660,owner=gopher:www", "thirteen.sock", 0660, "gopher:www", false},
+		{"unix:/run/thirteen.sock,mode=0600,serverport=70", "/run/thirteen.sock", 0600, "", false},
+		{"unix:", "", 0, "", true},
+		{"unix:/run/thirteen.sock,mode=888", "", 0, "", true},
+		{"unix:/run/thirteen.sock,mode=1777", "", 0, "", true},
+		{"unix:/run/thirteen.sock,owner=", "", 0, "", true},
+		{"70,mode=600", "", 0, "", true},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			at := assert.New(t)
+			l, err := parseListenSpec(tc.spec)
+			at.Equal(tc.isError, err != nil)
+			if err == nil {
+				at.Equal(tc.path, l.unixPath)
+				at.Equal(tc.mode, l.unixMode)
+				at.Equal(tc.owner, l.unixOwner)
+			}
+		})
+	}
+}
+
+func TestUnixListener(t *testing.T) {
+	at := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "thirteen.sock")
+	lc, err := parseListenSpec("unix:" + path + ",mode=600")
+	require.NoError(t, err)
+	listeners, err := openListeners([]*listenerConfig{lc})
+	require.NoError(t, err)
+	l := listeners[0]
+	defer l.Close()
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	at.Equal(os.FileMode(0600), fi.Mode().Perm())
+	at.Equal(defaultListen, lc.getServerPort())
+
+	d, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	defer d.Close()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	c := newClient(conn, l.config)
+	defer c.Close()
+
+	at.Equal(unixClientAddr, c.addr)
+	at.Equal("", c.port)
+	env := cgiEnv(c, "/", "/srv/gopher/index.cgi", "", "/", "", "")
+	at.Contains(env, "REMOTE_ADDR=unix:")
+	if runtime.GOOS != "linux" {
+		at.Nil(c.peer)
+		return
+	}
+	if at.NotNil(c.peer) {
+		at.Equal(os.Getuid(), c.peer.uid)
+		at.Equal(os.Getgid(), c.peer.gid)
+		at.Equal(os.Getpid(), c.peer.pid)
+		at.Contains(env, "REMOTE_UID="+strconv.Itoa(os.Getuid()))
+		at.Contains(env, "REMOTE_PID="+strconv.Itoa(os.Getpid()))
+	}
+}
+
+func TestUnixListenerStaleSocket(t *testing.T) {
+	at := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "thirteen.sock")
+	lc, err := parseListenSpec("unix:" + path)
+	require.NoError(t, err)
+
+	// a socket file left behind by a server that exited is replaced
+	old, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	require.NoError(t, err)
+	old.SetUnlinkOnClose(false)
+	old.Close()
+	listeners, err := openListeners([]*listenerConfig{lc})
+	require.NoError(t, err)
+
+	// but a socket that is in use is not
+	_, err = openListeners([]*listenerConfig{lc})
+	at.Error(err)
+
+	// and the socket file is removed when the listener is closed
+	closeListeners(listeners)
+	_, err = os.Stat(path)
+	at.True(os.IsNotExist(err))
+}